@@ -0,0 +1,38 @@
+// +build linux
+
+//By TimTheSinner
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+/**
+ * Copyright (c) 2016 TimTheSinner All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+var cpuListRegex = regexp.MustCompile(`^\d+(-\d+)?(,\d+(-\d+)?)*$`)
+
+func validateAffinity(cpus string) error {
+	if cpus != "" && !cpuListRegex.MatchString(cpus) {
+		return fmt.Errorf("Invalid CPU list %q, expected a taskset list like 0-3,6", cpus)
+	}
+	return nil
+}
+
+func affinityCommand(cpus string, command string, args []string) (string, []string) {
+	return "taskset", append([]string{"-c", cpus, command}, args...)
+}
@@ -0,0 +1,37 @@
+// +build !linux
+
+//By TimTheSinner
+package main
+
+import (
+	"errors"
+)
+
+/**
+ * Copyright (c) 2016 TimTheSinner All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+var ErrAffinityUnsupported = errors.New("CPU affinity is only supported on linux")
+
+func validateAffinity(cpus string) error {
+	if cpus != "" {
+		return ErrAffinityUnsupported
+	}
+	return nil
+}
+
+func affinityCommand(cpus string, command string, args []string) (string, []string) {
+	return command, args
+}
@@ -0,0 +1,340 @@
+//By TimTheSinner
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/**
+ * Copyright (c) 2016 TimTheSinner All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+var ErrNoDaemon = errors.New("No daemon is listening")
+
+type pathRequest struct {
+	Path string `json:"path"`
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		fmt.Println("Could not write API response", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, ErrJobNotFound) || os.IsNotExist(err):
+		status = http.StatusNotFound
+	case errors.Is(err, ErrNotInLibrary):
+		status = http.StatusBadRequest
+	case errors.Is(err, ErrJobNotPending) || errors.Is(err, ErrAlreadyProcessing) || errors.Is(err, ErrOriginalNotKept) || errors.Is(err, ErrNotTranscoded):
+		status = http.StatusConflict
+	}
+	writeJSON(w, status, apiError{err.Error()})
+}
+
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		writeJSON(w, http.StatusMethodNotAllowed, apiError{"Method not allowed"})
+		return false
+	}
+	return true
+}
+
+// parseHistoryQuery reads status, series, codec, since and until, dates are RFC 3339 or YYYY-MM-DD.
+func parseHistoryQuery(r *http.Request) (MetadataQuery, error) {
+	values := r.URL.Query()
+	query := MetadataQuery{Status: values.Get("status"), Series: values.Get("series"), Codec: values.Get("codec")}
+
+	switch query.Status {
+	case "", STATUS_TRANSCODED, STATUS_FAILED:
+	default:
+		return query, fmt.Errorf("Unknown status %q, expected %s or %s", query.Status, STATUS_TRANSCODED, STATUS_FAILED)
+	}
+
+	for _, date := range []struct {
+		name  string
+		value *time.Time
+	}{{"since", &query.Since}, {"until", &query.Until}} {
+		raw := values.Get(date.name)
+		if raw == "" {
+			continue
+		}
+
+		parsed, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			if parsed, err = time.ParseInLocation("2006-01-02", raw, time.Local); err != nil {
+				return query, fmt.Errorf("Could not parse %s: %v", date.name, err)
+			}
+		}
+		*date.value = parsed
+	}
+	return query, nil
+}
+
+func readPathRequest(w http.ResponseWriter, r *http.Request) (string, bool) {
+	var request pathRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{"Could not decode request: " + err.Error()})
+		return "", false
+	} else if strings.TrimSpace(request.Path) == "" {
+		writeJSON(w, http.StatusBadRequest, apiError{"path is required"})
+		return "", false
+	}
+	return request.Path, true
+}
+
+// NewAPI serves the daemon state as JSON:
+//
+//	GET  /api/queue              pending and running jobs
+//	GET  /api/jobs?state=failed  every job, optionally filtered by state
+//	GET  /api/jobs/{id}
+//	POST /api/jobs/{id}/cancel
+//	GET  /api/running            jobs currently held by a worker, with their latest progress
+//	GET  /api/progress           server sent event stream of encoder progress
+//	GET  /api/history            transcode history of every library, filtered by ?status=failed&series=&codec=h264&since=2020-01-01&until=
+//	POST /api/enqueue            {"path": "/movies/Some Movie"}
+//	POST /api/rerun              {"path": "/movies/Some Movie"}
+func NewAPI(daemon *Daemon) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/api/queue", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+
+		jobs, err := daemon.queue.Jobs(JOB_RUNNING, JOB_PENDING)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, jobs)
+	})
+
+	mux.HandleFunc("/api/jobs", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+
+		states := make([]JobState, 0)
+		for _, state := range r.URL.Query()["state"] {
+			states = append(states, JobState(state))
+		}
+
+		jobs, err := daemon.queue.Jobs(states...)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, jobs)
+	})
+
+	mux.HandleFunc("/api/jobs/", func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/jobs/"), "/"), "/")
+		id, err := strconv.ParseUint(parts[0], 10, 64)
+		if err != nil || len(parts) > 2 || (len(parts) == 2 && parts[1] != "cancel") {
+			writeJSON(w, http.StatusNotFound, apiError{"Not found"})
+			return
+		}
+
+		if len(parts) == 1 {
+			if !allowMethod(w, r, http.MethodGet) {
+				return
+			}
+
+			job, err := daemon.queue.Job(id)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, job)
+			return
+		}
+
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+
+		job, err := daemon.Cancel(id)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, job)
+	})
+
+	mux.HandleFunc("/api/running", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+		writeJSON(w, http.StatusOK, daemon.Running())
+	})
+
+	mux.HandleFunc("/api/progress", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			writeJSON(w, http.StatusInternalServerError, apiError{"Streaming is not supported"})
+			return
+		}
+
+		subscriber := daemon.progress.Subscribe()
+		defer daemon.progress.Unsubscribe(subscriber)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case progress := <-subscriber:
+				raw, err := json.Marshal(progress)
+				if err != nil {
+					fmt.Println("Could not encode progress", err)
+					continue
+				}
+				fmt.Fprintf(w, "event: progress\ndata: %s\n\n", raw)
+				flusher.Flush()
+			}
+		}
+	})
+
+	mux.HandleFunc("/api/history", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+
+		query, err := parseHistoryQuery(r)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, apiError{err.Error()})
+			return
+		}
+
+		history := make(map[string][]*Transcode)
+		for _, library := range daemon.config.Libraries {
+			transcodes, err := library.store.Query(query)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			history[library.Path] = transcodes
+		}
+		writeJSON(w, http.StatusOK, history)
+	})
+
+	mux.HandleFunc("/api/enqueue", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+
+		path, ok := readPathRequest(w, r)
+		if !ok {
+			return
+		}
+
+		job, err := daemon.Enqueue(path)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusAccepted, job)
+	})
+
+	mux.HandleFunc("/api/rerun", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+
+		path, ok := readPathRequest(w, r)
+		if !ok {
+			return
+		}
+
+		job, err := daemon.Rerun(path)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusAccepted, job)
+	})
+
+	return mux
+}
+
+// apiURL is where a client on this machine reaches an API listening on address.
+func apiURL(address, path string) string {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "http://" + address + path
+	} else if host == "" || net.ParseIP(host).IsUnspecified() {
+		host = "localhost"
+	}
+	return "http://" + net.JoinHostPort(host, port) + path
+}
+
+// fetchJobs asks the daemon listening on address for its jobs, ErrNoDaemon when nothing answers.
+func fetchJobs(address string) ([]*Job, error) {
+	client := http.Client{Timeout: 10 * time.Second}
+	response, err := client.Get(apiURL(address, "/api/jobs"))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNoDaemon, err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		var failure apiError
+		json.NewDecoder(response.Body).Decode(&failure)
+		return nil, fmt.Errorf("Daemon answered %s: %s", response.Status, failure.Error)
+	}
+
+	jobs := make([]*Job, 0)
+	if err := json.NewDecoder(response.Body).Decode(&jobs); err != nil {
+		return nil, fmt.Errorf("Could not decode jobs: %v", err)
+	}
+	return jobs, nil
+}
+
+func serveAPI(address string, daemon *Daemon) *http.Server {
+	server := &http.Server{Addr: address, Handler: NewAPI(daemon)}
+	go func() {
+		fmt.Println("Serving API on", address)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fmt.Println("API server stopped", err)
+		}
+	}()
+	return server
+}
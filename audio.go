@@ -0,0 +1,275 @@
+//By TimTheSinner
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/**
+ * Copyright (c) 2016 TimTheSinner All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+const (
+	// Matches every audio format in an audio rule
+	AUDIO_ANY = "*"
+	// DTS-HD MA, HRA and DTS:X, ffprobe names them all dts and only the profile tells them from lossy core DTS
+	AUDIO_DTS_HD = "dts-hd"
+)
+
+const (
+	// The first original track is the default, each stereo downmix follows the track it came from
+	DEFAULT_AUDIO_ORIGINAL = "original"
+	// The first stereo downmix is the default, each downmix comes before the track it came from
+	DEFAULT_AUDIO_STEREO = "stereo"
+)
+
+// Dolby Pro Logic II keeps the surrounds recoverable by receivers while sounding right on plain stereo
+const DEFAULT_DOWNMIX_FILTER = "aresample=matrix_encoding=dplii,aformat=channel_layouts=stereo"
+
+// Default bitrates by channel count for transcoded audio, sized for Opus
+var DEFAULT_AUDIO_BITRATES = map[int]string{1: "96k", 2: "128k", 6: "256k", 8: "384k"}
+
+// The channel layout libopus expects for each channel count, anything wider is downmixed to 7.1
+var OPUS_CHANNEL_LAYOUTS = []string{"", "mono", "stereo", "3.0", "quad", "5.0", "5.1", "6.1", "7.1"}
+
+// Formats mp4 cannot carry, passthrough rules for them are skipped in mp4 profiles
+var MP4_UNSUPPORTED_AUDIO = map[string]bool{"truehd": true, AUDIO_DTS_HD: true}
+
+// AudioRule picks how kept audio streams of the listed formats are encoded, the first matching rule wins.
+// Formats are ffprobe codec names, dts-hd or * for anything, Codec is an ffmpeg audio encoder or copy.
+type AudioRule struct {
+	Formats []string `json:"formats"`
+	Codec   string   `json:"codec"`
+	// Bitrates by channel count override the profile audioBitrates for this rule
+	Bitrates map[int]string `json:"bitrates,omitempty"`
+}
+
+// StereoPolicy adds a stereo downmix alongside every kept multichannel track for players that cannot decode surround.
+type StereoPolicy struct {
+	Codec   string `json:"codec,omitempty"`
+	Bitrate string `json:"bitrate,omitempty"`
+	Filter  string `json:"filter,omitempty"`
+	// Default is original or stereo, deciding which kind of track comes first and is flagged default
+	Default string `json:"default,omitempty"`
+}
+
+func flagStereoPolicy() *StereoPolicy {
+	if *stereoCodec == "" {
+		return nil
+	}
+	return &StereoPolicy{Codec: *stereoCodec, Default: *defaultAudio}
+}
+
+func (p *StereoPolicy) applyDefaults() {
+	if p.Codec == "" {
+		p.Codec = "aac"
+	}
+	if p.Bitrate == "" {
+		p.Bitrate = DEFAULT_AUDIO_BITRATES[2]
+	}
+	if p.Filter == "" {
+		p.Filter = DEFAULT_DOWNMIX_FILTER
+	}
+	if p.Default == "" {
+		p.Default = DEFAULT_AUDIO_ORIGINAL
+	}
+}
+
+func (p *StereoPolicy) Validate() error {
+	switch p.Codec {
+	case "aac", "libopus":
+	default:
+		return fmt.Errorf("Stereo codec %q is not supported, expected aac or libopus", p.Codec)
+	}
+
+	switch p.Default {
+	case DEFAULT_AUDIO_ORIGINAL, DEFAULT_AUDIO_STEREO:
+		return nil
+	default:
+		return fmt.Errorf("Unknown default audio %q, expected %s or %s", p.Default, DEFAULT_AUDIO_ORIGINAL, DEFAULT_AUDIO_STEREO)
+	}
+}
+
+// withStereoTracks adds a downmix for each multichannel track whose language has no stereo track kept already.
+func (p *StereoPolicy) withStereoTracks(audio []*SelectedStream) []*SelectedStream {
+	if p == nil {
+		return audio
+	}
+
+	stereo := make(map[string]bool)
+	for _, stream := range audio {
+		if stream.Channels > 0 && stream.Channels <= 2 {
+			stereo[stream.Language] = true
+		}
+	}
+
+	tracks := make([]*SelectedStream, 0, len(audio)*2)
+	for _, stream := range audio {
+		if stream.Channels <= 2 || stereo[stream.Language] {
+			tracks = append(tracks, stream)
+			continue
+		}
+
+		downmix := *stream
+		downmix.Downmix = true
+		if p.Default == DEFAULT_AUDIO_STEREO {
+			tracks = append(tracks, &downmix, stream)
+		} else {
+			tracks = append(tracks, stream, &downmix)
+		}
+	}
+	return tracks
+}
+
+// downmixTitle describes a downmix by the track it came from, like "Stereo (English 7.1)".
+func downmixTitle(stream *SelectedStream) string {
+	if title := stream.Title(); title != "" {
+		return "Stereo (" + title + ")"
+	}
+
+	layout := stream.ChannelLayout
+	if layout == "" {
+		layout = strconv.Itoa(stream.Channels) + " channels"
+	}
+	return "Stereo (" + layout + ")"
+}
+
+func flagAudioRules() []AudioRule {
+	passthrough := splitLanguages(*audioPassthrough)
+	if len(passthrough) == 0 {
+		return []AudioRule{}
+	}
+	return []AudioRule{{Formats: passthrough, Codec: "copy"}}
+}
+
+func (r AudioRule) Validate() error {
+	if len(r.Formats) == 0 {
+		return fmt.Errorf("Audio rule must list at least one format")
+	} else if strings.TrimSpace(r.Codec) == "" {
+		return fmt.Errorf("Audio rule for %s must name a codec", strings.Join(r.Formats, ","))
+	}
+	return validateBitrates(r.Bitrates)
+}
+
+func validateBitrates(bitrates map[int]string) error {
+	for channels, bitrate := range bitrates {
+		if channels <= 0 {
+			return fmt.Errorf("Audio bitrate channel counts must be positive, got %d", channels)
+		} else if strings.TrimSpace(bitrate) == "" {
+			return fmt.Errorf("Audio bitrate for %d channels is empty", channels)
+		}
+	}
+	return nil
+}
+
+func (r AudioRule) matches(format string) bool {
+	for _, candidate := range r.Formats {
+		if candidate == AUDIO_ANY || strings.EqualFold(candidate, format) {
+			return true
+		}
+	}
+	return false
+}
+
+// audioFormat is the ffprobe codec name, with DTS-HD told apart from core DTS.
+func audioFormat(stream *Stream) string {
+	if stream.CodecName == "dts" && strings.HasPrefix(stream.Profile, "DTS-HD") {
+		return AUDIO_DTS_HD
+	}
+	return stream.CodecName
+}
+
+// bitrateFor picks the entry for the widest channel count not above channels, falling back to fallback.
+func bitrateFor(bitrates map[int]string, channels int, fallback string) string {
+	best := 0
+	for count := range bitrates {
+		if count <= channels && count > best {
+			best = count
+		}
+	}
+	if best == 0 {
+		return fallback
+	}
+	return bitrates[best]
+}
+
+// opusLayout is the layout libopus accepts for a stream, unusual layouts like 5.1(side) are remapped onto it.
+func opusLayout(channels int) string {
+	if channels <= 0 {
+		return ""
+	} else if channels >= len(OPUS_CHANNEL_LAYOUTS) {
+		return OPUS_CHANNEL_LAYOUTS[len(OPUS_CHANNEL_LAYOUTS)-1]
+	}
+	return OPUS_CHANNEL_LAYOUTS[channels]
+}
+
+// audioEncoding resolves the codec and bitrate for a kept audio stream, the bitrate is empty for copies.
+func (p *Profile) audioEncoding(stream *Stream) (codec, bitrate string) {
+	format := audioFormat(stream)
+	for _, rule := range p.AudioRules {
+		if !rule.matches(format) {
+			continue
+		} else if rule.Codec == "copy" && p.Container == "mp4" && MP4_UNSUPPORTED_AUDIO[format] {
+			continue
+		}
+
+		if rule.Codec == "copy" {
+			return rule.Codec, ""
+		}
+		return rule.Codec, bitrateFor(rule.Bitrates, stream.Channels, bitrateFor(p.AudioBitrates, stream.Channels, p.AudioBitrate))
+	}
+
+	if p.AudioCodec == "copy" {
+		return p.AudioCodec, ""
+	}
+	return p.AudioCodec, bitrateFor(p.AudioBitrates, stream.Channels, p.AudioBitrate)
+}
+
+// audioArgs encodes each kept audio stream, output audio stream i is audio[i].
+func (p *Profile) audioArgs(audio []*SelectedStream) []string {
+	args := make([]string, 0)
+	for i, stream := range audio {
+		spec := ":a:" + strconv.Itoa(i)
+		if p.Stereo != nil {
+			disposition := "0"
+			if i == 0 {
+				disposition = "default"
+			}
+			args = append(args, "-disposition"+spec, disposition)
+		}
+
+		codec, bitrate := p.audioEncoding(stream.Stream)
+		if stream.Downmix {
+			codec, bitrate = p.Stereo.Codec, p.Stereo.Bitrate
+			args = append(args, "-filter"+spec, p.Stereo.Filter, "-metadata:s"+spec, "title="+downmixTitle(stream))
+		}
+
+		args = append(args, "-c"+spec, codec)
+		if codec == "copy" {
+			continue
+		}
+		args = append(args, "-b"+spec, bitrate)
+
+		if codec == "libopus" {
+			if layout := opusLayout(stream.Channels); layout != "" && !stream.Downmix {
+				args = append(args, "-filter"+spec, "aformat=channel_layouts="+layout)
+			}
+			args = append(args, "-vbr"+spec, "on", "-compression_level"+spec, "10", "-frame_duration"+spec, "10")
+		}
+	}
+	return args
+}
@@ -0,0 +1,141 @@
+//By TimTheSinner
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+/**
+ * Copyright (c) 2016 TimTheSinner All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+func audioStream(codec, profile string, channels int) *SelectedStream {
+	return &SelectedStream{Stream: &Stream{CodecName: codec, CodecType: "audio", Profile: profile, Channels: channels}, Language: "eng"}
+}
+
+func TestAudioArgs(t *testing.T) {
+	profile := flagProfile()
+	opus := []string{"-vbr:a:0", "on", "-compression_level:a:0", "10", "-frame_duration:a:0", "10"}
+
+	tests := []struct {
+		name      string
+		container string
+		stream    *SelectedStream
+		expected  []string
+	}{
+		{"truehd atmos is copied", "mkv", audioStream("truehd", "", 8), []string{"-c:a:0", "copy"}},
+		{"dts:x is copied", "mkv", audioStream("dts", "DTS-HD MA + DTS:X", 8), []string{"-c:a:0", "copy"}},
+		{"flac is copied", "mkv", audioStream("flac", "", 2), []string{"-c:a:0", "copy"}},
+		{"core dts is transcoded", "mkv", audioStream("dts", "DTS", 6),
+			append([]string{"-c:a:0", "libopus", "-b:a:0", "256k", "-filter:a:0", "aformat=channel_layouts=5.1"}, opus...)},
+		{"stereo aac is transcoded", "mkv", audioStream("aac", "LC", 2),
+			append([]string{"-c:a:0", "libopus", "-b:a:0", "128k", "-filter:a:0", "aformat=channel_layouts=stereo"}, opus...)},
+		{"odd layouts use the narrower bitrate", "mkv", audioStream("ac3", "", 5),
+			append([]string{"-c:a:0", "libopus", "-b:a:0", "128k", "-filter:a:0", "aformat=channel_layouts=5.0"}, opus...)},
+		{"wide layouts are downmixed to 7.1", "mkv", audioStream("pcm_s24le", "", 12),
+			append([]string{"-c:a:0", "libopus", "-b:a:0", "384k", "-filter:a:0", "aformat=channel_layouts=7.1"}, opus...)},
+		{"mp4 cannot carry truehd", "mp4", audioStream("truehd", "", 8),
+			append([]string{"-c:a:0", "libopus", "-b:a:0", "384k", "-filter:a:0", "aformat=channel_layouts=7.1"}, opus...)},
+	}
+
+	for _, test := range tests {
+		profile.Container = test.container
+		if args := profile.audioArgs([]*SelectedStream{test.stream}); !reflect.DeepEqual(args, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, args)
+		}
+	}
+}
+
+func TestAudioRulesOverrideProfile(t *testing.T) {
+	profile := &Profile{
+		Container:     "mkv",
+		AudioCodec:    "copy",
+		AudioBitrates: DEFAULT_AUDIO_BITRATES,
+		AudioRules: []AudioRule{
+			{Formats: []string{"eac3"}, Codec: "aac", Bitrates: map[int]string{2: "192k"}},
+			{Formats: []string{AUDIO_ANY}, Codec: "ac3"},
+		},
+	}
+
+	args := profile.audioArgs([]*SelectedStream{audioStream("eac3", "", 2), audioStream("mp3", "", 6)})
+	expected := []string{"-c:a:0", "aac", "-b:a:0", "192k", "-c:a:1", "ac3", "-b:a:1", "256k"}
+	if !reflect.DeepEqual(args, expected) {
+		t.Errorf("Expected %v, got %v", expected, args)
+	}
+
+	// An empty rule list is kept rather than inheriting the passthrough defaults
+	profile.AudioRules = []AudioRule{}
+	profile.inherit(flagProfile())
+	if args := profile.audioArgs([]*SelectedStream{audioStream("truehd", "", 8)}); !reflect.DeepEqual(args, []string{"-c:a:0", "copy"}) {
+		t.Errorf("Expected the profile codec, got %v", args)
+	}
+}
+
+func TestProfileAudioBitrate(t *testing.T) {
+	profile := &Profile{AudioBitrate: "192k"}
+	profile.inherit(flagProfile())
+	if _, bitrate := profile.audioEncoding(audioStream("eac3", "", 6).Stream); bitrate != "192k" {
+		t.Errorf("Expected the profile bitrate, got %s", bitrate)
+	}
+
+	// Without a bitrate of its own the profile picks from the defaults by channel count
+	profile = &Profile{}
+	profile.inherit(flagProfile())
+	if _, bitrate := profile.audioEncoding(audioStream("eac3", "", 6).Stream); bitrate != DEFAULT_AUDIO_BITRATES[6] {
+		t.Errorf("Expected the default 5.1 bitrate, got %s", bitrate)
+	}
+}
+
+func TestStereoTracks(t *testing.T) {
+	surround := audioStream("truehd", "", 8)
+	surround.ChannelLayout = "7.1"
+	commentary := audioStream("ac3", "", 2)
+	french := audioStream("ac3", "", 6)
+	french.Language = "fre"
+	french.Tags.Title = "Français 5.1"
+
+	profile := &Profile{Container: "mkv", AudioCodec: "libopus", AudioBitrates: DEFAULT_AUDIO_BITRATES, Stereo: &StereoPolicy{Default: DEFAULT_AUDIO_STEREO}}
+	profile.Stereo.applyDefaults()
+
+	tracks := profile.Stereo.withStereoTracks([]*SelectedStream{surround, french})
+	if len(tracks) != 4 || !tracks[0].Downmix || tracks[1] != surround || !tracks[2].Downmix || tracks[3] != french {
+		t.Fatalf("Expected each downmix ahead of its source %+v", tracks)
+	}
+
+	expected := []string{
+		"-disposition:a:0", "default", "-filter:a:0", DEFAULT_DOWNMIX_FILTER, "-metadata:s:a:0", "title=Stereo (7.1)", "-c:a:0", "aac", "-b:a:0", "128k",
+		"-disposition:a:1", "0", "-c:a:1", "libopus", "-b:a:1", "384k", "-filter:a:1", "aformat=channel_layouts=7.1",
+		"-vbr:a:1", "on", "-compression_level:a:1", "10", "-frame_duration:a:1", "10",
+	}
+	if args := profile.audioArgs(tracks[:2]); !reflect.DeepEqual(args, expected) {
+		t.Errorf("Expected %v, got %v", expected, args)
+	}
+	if title := downmixTitle(tracks[2]); title != "Stereo (Français 5.1)" {
+		t.Errorf("Unexpected title %q", title)
+	}
+
+	// A language with a stereo track already kept gets no downmix
+	profile.Stereo.Default = DEFAULT_AUDIO_ORIGINAL
+	tracks = profile.Stereo.withStereoTracks([]*SelectedStream{surround, commentary, french})
+	if len(tracks) != 4 || tracks[0] != surround || tracks[1] != commentary || tracks[2] != french || !tracks[3].Downmix {
+		t.Errorf("Expected only the french track to be downmixed %+v", tracks)
+	}
+
+	var disabled *StereoPolicy
+	if tracks := disabled.withStereoTracks([]*SelectedStream{surround}); len(tracks) != 1 {
+		t.Errorf("Expected no downmix without a stereo policy")
+	}
+}
@@ -2,14 +2,13 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"log"
 	"os"
 	"os/exec"
 	"strings"
-	"sync"
+	"time"
 )
 
 /**
@@ -28,74 +27,141 @@ import (
  * limitations under the License.
  */
 
-func runCommand(command string, args ...string) bool {
-	cmd := exec.Command(command, args...)
+// How long a cancelled command is given to exit cleanly before it is killed
+const STOP_TIMEOUT = 30 * time.Second
 
-	cmd.Stderr = os.Stderr
-	cmd.Stdout = os.Stdout
+// How much of stderr is kept for failure reports
+const STDERR_TAIL = 4096
 
-	fmt.Println("Running "+command+" with:", args)
-	err := cmd.Run()
-	if err != nil {
-		fmt.Println("Error executing "+command, err)
-		return false
-	}
-	return true
+// CommandError describes a command that did not exit cleanly, ExitStatus is -1 when it never ran or was killed.
+type CommandError struct {
+	Command    string
+	ExitStatus int
+	Stderr     string
+	Err        error
 }
 
-func runCommandOutput(command string, args ...string) string {
-	cmd := exec.Command(command, args...)
+func (e *CommandError) Error() string {
+	return fmt.Sprintf("%s exited with status %d: %v", e.Command, e.ExitStatus, e.Err)
+}
 
-	cmd.Stderr = os.Stderr
+// tailWriter remembers the last limit bytes written to it.
+type tailWriter struct {
+	limit int
+	tail  []byte
+}
 
-	//fmt.Println("Running "+command+" with:", args)
-	output, err := cmd.Output()
-	if err != nil {
-		fmt.Println("Error executing "+command, err)
+func (t *tailWriter) Write(p []byte) (int, error) {
+	t.tail = append(t.tail, p...)
+	if len(t.tail) > t.limit {
+		t.tail = t.tail[len(t.tail)-t.limit:]
 	}
+	return len(p), nil
+}
 
-	return strings.TrimSpace(string(output))
+// String drops the first, most likely partial, line once the tail has been truncated.
+func (t *tailWriter) String() string {
+	tail := string(t.tail)
+	if len(t.tail) == t.limit {
+		if newline := strings.IndexByte(tail, '\n'); newline >= 0 {
+			tail = tail[newline+1:]
+		}
+	}
+	return strings.TrimSpace(tail)
 }
 
-func runCommandCaptureError(command string, args ...string) string {
-	pr, pw := io.Pipe()
-	// we need to wait for everything to be done
-	wg := sync.WaitGroup{}
-	wg.Add(2)
+// Executor runs the external tools the transcode pipeline depends on, tests swap in a scripted fake.
+type Executor interface {
+	// Run streams stdout to the writer and returns the tail of stderr, failures are a *CommandError
+	Run(ctx context.Context, stdout io.Writer, command string, args ...string) (stderr string, err error)
+	// Output returns everything the command wrote to stdout
+	Output(ctx context.Context, command string, args ...string) ([]byte, error)
+}
+
+// SystemExecutor runs commands on this machine.
+type SystemExecutor struct{}
+
+func (SystemExecutor) Run(ctx context.Context, stdout io.Writer, command string, args ...string) (string, error) {
+	return runCommandStderr(ctx, stdout, command, args...)
+}
+
+func (SystemExecutor) Output(ctx context.Context, command string, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, command, args...)
+	cmd.Stderr = os.Stderr
+	output, err := cmd.Output()
+	if ctx.Err() != nil {
+		// Killed because we are stopping, not because the command failed
+		return nil, ctx.Err()
+	}
+	return output, err
+}
 
+// runCommandStderr interrupts the command when ctx is cancelled so ffmpeg can close its output, killing it if it lingers.
+// It returns the tail of stderr, where ffmpeg filters print their summaries.
+func runCommandStderr(ctx context.Context, stdout io.Writer, command string, args ...string) (string, error) {
 	cmd := exec.Command(command, args...)
-	cmd.Stdout = os.Stdout
-	stdErr, err := cmd.StderrPipe()
-	if err != nil {
+
+	stderr := &tailWriter{limit: STDERR_TAIL}
+	cmd.Stderr = io.MultiWriter(os.Stderr, stderr)
+	cmd.Stdout = stdout
+
+	fmt.Println("Running "+command+" with:", args)
+	if err := cmd.Start(); err != nil {
 		fmt.Println("Error executing "+command, err)
+		return "", &CommandError{command, -1, "", err}
 	}
-	tee := io.TeeReader(stdErr, pw)
 
-	var output string
+	exited := make(chan struct{})
+	defer close(exited)
 	go func() {
-		defer wg.Done()
-		defer pw.Close()
-
-		if b, _err := ioutil.ReadAll(tee); _err != nil {
-			log.Fatal(_err)
-		} else {
-			output = fmt.Sprintf("%s", b)
+		select {
+		case <-exited:
+			return
+		case <-ctx.Done():
 		}
-	}()
 
-	go func() {
-		defer wg.Done()
+		fmt.Println("Stopping "+command, ctx.Err())
+		if err := interruptProcess(cmd.Process); err != nil {
+			cmd.Process.Kill()
+			return
+		}
 
-		if _, _err := io.Copy(os.Stderr, pr); _err != nil {
-			log.Fatal(_err)
+		select {
+		case <-exited:
+		case <-time.After(STOP_TIMEOUT):
+			fmt.Println("Killing "+command, "after", STOP_TIMEOUT)
+			cmd.Process.Kill()
 		}
 	}()
 
-	fmt.Println("Running "+command+" with:", args)
-	if err := cmd.Run(); err != nil {
+	err := cmd.Wait()
+	if ctx.Err() != nil {
+		return stderr.String(), ctx.Err()
+	} else if err != nil {
+		fmt.Println("Error executing "+command, err)
+		status := -1
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			status = exitErr.ExitCode()
+		}
+		return stderr.String(), &CommandError{command, status, stderr.String(), err}
+	}
+	return stderr.String(), nil
+}
+
+func runCommandOutput(command string, args ...string) string {
+	output, err := runCommandOutputError(command, args...)
+	if err != nil {
 		fmt.Println("Error executing "+command, err)
 	}
 
-	wg.Wait()
-	return strings.TrimSpace(output)
+	return strings.TrimSpace(string(output))
+}
+
+func runCommandOutputError(command string, args ...string) ([]byte, error) {
+	cmd := exec.Command(command, args...)
+
+	cmd.Stderr = os.Stderr
+
+	//fmt.Println("Running "+command+" with:", args)
+	return cmd.Output()
 }
@@ -0,0 +1,445 @@
+//By TimTheSinner
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/**
+ * Copyright (c) 2016 TimTheSinner All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// A movie directory containing this file is transcoded with the profile named inside it
+const PROFILE_OVERRIDE_FILE = "transcode-profile"
+
+const DEFAULT_PROFILE = "default"
+
+// Profile describes how a movie is encoded, unset fields inherit from the command line flags.
+type Profile struct {
+	Name string `json:"-"`
+
+	VideoCodec string `json:"videoCodec,omitempty"`
+	Quality    int    `json:"quality,omitempty"`
+	Preset     string `json:"preset,omitempty"`
+	Tune       string `json:"tune,omitempty"`
+	PixFmt     string `json:"pixFmt,omitempty"`
+	MaxWidth   int    `json:"maxWidth,omitempty"`
+	MaxHeight  int    `json:"maxHeight,omitempty"`
+	// ScaleAlgorithm is the swscale algorithm frames are scaled down with, empty uses ffmpeg's default
+	ScaleAlgorithm string `json:"scaleAlgorithm,omitempty"`
+	// MaxFrameRate drops frames of faster sources down to a rate like 30000/1001
+	MaxFrameRate string `json:"maxFrameRate,omitempty"`
+	// Denoise is a light, medium or strong hqdn3d pass before scaling, empty keeps the grain
+	Denoise string `json:"denoise,omitempty"`
+	// Deinterlace fixes interlaced and telecined sources
+	Deinterlace *DeinterlacePolicy `json:"deinterlace,omitempty"`
+	// Crop detects black bars and crops them away, nil encodes the full frame
+	Crop *CropPolicy `json:"crop,omitempty"`
+	// HDR is preserve to keep HDR10 and HLG sources HDR when the video codec can carry it, or sdr
+	HDR string `json:"hdr,omitempty"`
+	// Tonemap maps HDR sources into SDR when the encode will be SDR
+	Tonemap *TonemapPolicy `json:"tonemap,omitempty"`
+
+	AudioCodec   string `json:"audioCodec,omitempty"`
+	AudioBitrate string `json:"audioBitrate,omitempty"`
+	// AudioBitrates by channel count, a stream uses the entry for the widest count not above its own
+	AudioBitrates map[int]string `json:"audioBitrates,omitempty"`
+	// AudioRules override audioCodec by source format, an empty list transcodes everything with audioCodec
+	AudioRules []AudioRule `json:"audioRules,omitempty"`
+	// Stereo adds compatibility downmixes of multichannel audio, nil keeps only the original tracks
+	Stereo *StereoPolicy `json:"stereo,omitempty"`
+
+	// SubtitleCodec is an ffmpeg subtitle encoder, copy, or none to drop subtitles entirely
+	SubtitleCodec string `json:"subtitleCodec,omitempty"`
+	// ExtractSubtitles writes kept embedded text subtitles to srt sidecars for players that only read external files
+	ExtractSubtitles bool `json:"extractSubtitles,omitempty"`
+
+	Container string `json:"container,omitempty"`
+
+	// Verify gates replacing the original on the encode matching it, nil replaces as soon as ffmpeg succeeds
+	Verify *VerifyPolicy `json:"verify,omitempty"`
+}
+
+type Library struct {
+	Path      string         `json:"path"`
+	Profile   string         `json:"profile,omitempty"`
+	Languages LanguagePolicy `json:"languages"`
+
+	// Retention overrides the config retention policy for this library
+	Retention *RetentionPolicy `json:"retention,omitempty"`
+
+	store MetadataStore
+}
+
+type Config struct {
+	DefaultProfile string              `json:"defaultProfile,omitempty"`
+	Profiles       map[string]*Profile `json:"profiles,omitempty"`
+	Languages      LanguagePolicy      `json:"languages"`
+	Libraries      []*Library          `json:"libraries,omitempty"`
+	Workers        []*Worker           `json:"workers,omitempty"`
+	Queue          string              `json:"queue,omitempty"`
+	HTTP           string              `json:"http,omitempty"`
+	Retry          *RetryPolicy        `json:"retry,omitempty"`
+	Retention      *RetentionPolicy    `json:"retention,omitempty"`
+	MetadataStore  string              `json:"metadataStore,omitempty"`
+}
+
+func flagProfile() *Profile {
+	return &Profile{
+		Name:             DEFAULT_PROFILE,
+		VideoCodec:       *codec,
+		Quality:          *crf,
+		Preset:           *speed,
+		Tune:             "fastdecode",
+		PixFmt:           *pixFmt,
+		MaxWidth:         1920,
+		Deinterlace:      flagDeinterlacePolicy(),
+		Crop:             flagCropPolicy(),
+		HDR:              *hdrMode,
+		Tonemap:          flagTonemapPolicy(),
+		AudioCodec:       "libopus",
+		AudioBitrate:     "256k",
+		AudioBitrates:    DEFAULT_AUDIO_BITRATES,
+		AudioRules:       flagAudioRules(),
+		Stereo:           flagStereoPolicy(),
+		SubtitleCodec:    *subtitleCodec,
+		ExtractSubtitles: *extractSubtitlesFlag,
+		Container:        "mkv",
+		Verify:           flagVerifyPolicy(),
+	}
+}
+
+func flagLanguages() LanguagePolicy {
+	return LanguagePolicy{
+		Audio:         splitLanguages(*audioLanguages),
+		Subtitles:     splitLanguages(*subtitleLanguages),
+		AudioFallback: *audioFallback,
+	}
+}
+
+// inherit fills every unset field from defaults.
+func (p *Profile) inherit(defaults *Profile) {
+	if p.VideoCodec == "" {
+		p.VideoCodec = defaults.VideoCodec
+	}
+	if p.Quality == 0 {
+		p.Quality = defaults.Quality
+	}
+	if p.Preset == "" {
+		p.Preset = defaults.Preset
+	}
+	if p.Tune == "" {
+		p.Tune = defaults.Tune
+	}
+	if p.PixFmt == "" {
+		p.PixFmt = defaults.PixFmt
+	}
+	if p.MaxWidth == 0 {
+		p.MaxWidth = defaults.MaxWidth
+	}
+	if p.MaxHeight == 0 {
+		p.MaxHeight = defaults.MaxHeight
+	}
+	if p.ScaleAlgorithm == "" {
+		p.ScaleAlgorithm = defaults.ScaleAlgorithm
+	}
+	if p.MaxFrameRate == "" {
+		p.MaxFrameRate = defaults.MaxFrameRate
+	}
+	if p.Denoise == "" {
+		p.Denoise = defaults.Denoise
+	}
+	if p.Deinterlace == nil {
+		deinterlace := *defaults.Deinterlace
+		p.Deinterlace = &deinterlace
+	} else {
+		p.Deinterlace.inherit(defaults.Deinterlace)
+	}
+	if p.Crop == nil && defaults.Crop != nil {
+		crop := *defaults.Crop
+		p.Crop = &crop
+	}
+	if p.HDR == "" {
+		p.HDR = defaults.HDR
+	}
+	if p.Tonemap == nil {
+		tonemap := *defaults.Tonemap
+		p.Tonemap = &tonemap
+	} else {
+		p.Tonemap.inherit(defaults.Tonemap)
+	}
+	if p.AudioCodec == "" {
+		p.AudioCodec = defaults.AudioCodec
+	}
+	// A profile that sets its own bitrate wants it for every stream, not the default per channel table
+	if p.AudioBitrates == nil && p.AudioBitrate == "" {
+		p.AudioBitrates = defaults.AudioBitrates
+	}
+	if p.AudioBitrate == "" {
+		p.AudioBitrate = defaults.AudioBitrate
+	}
+	if p.AudioRules == nil {
+		p.AudioRules = defaults.AudioRules
+	}
+	if p.Stereo == nil && defaults.Stereo != nil {
+		stereo := *defaults.Stereo
+		p.Stereo = &stereo
+	}
+	if p.SubtitleCodec == "" {
+		p.SubtitleCodec = defaults.SubtitleCodec
+	}
+	if !p.ExtractSubtitles {
+		p.ExtractSubtitles = defaults.ExtractSubtitles
+	}
+	if p.Container == "" {
+		p.Container = defaults.Container
+	}
+	if p.Verify == nil && defaults.Verify != nil {
+		verify := *defaults.Verify
+		p.Verify = &verify
+	}
+}
+
+func (p *Profile) Validate() error {
+	switch p.Container {
+	case "mkv", "mp4":
+	default:
+		return fmt.Errorf("Profile %s has unsupported container %q, expected mkv or mp4", p.Name, p.Container)
+	}
+
+	if p.MaxWidth < 0 || p.MaxHeight < 0 {
+		return fmt.Errorf("Profile %s has a negative maxWidth or maxHeight", p.Name)
+	} else if p.ScaleAlgorithm != "" && !SCALE_ALGORITHMS[p.ScaleAlgorithm] {
+		return fmt.Errorf("Profile %s has unknown scaleAlgorithm %q", p.Name, p.ScaleAlgorithm)
+	} else if _, ok := DENOISE_FILTERS[p.Denoise]; p.Denoise != "" && !ok {
+		return fmt.Errorf("Profile %s has unknown denoise %q, expected light, medium or strong", p.Name, p.Denoise)
+	}
+	if p.MaxFrameRate != "" {
+		if rate, err := parseRational(p.MaxFrameRate); err != nil || rate <= 0 {
+			return fmt.Errorf("Profile %s has invalid maxFrameRate %q", p.Name, p.MaxFrameRate)
+		}
+	}
+
+	p.Deinterlace.applyDefaults()
+	if err := p.Deinterlace.Validate(); err != nil {
+		return fmt.Errorf("Profile %s: %v", p.Name, err)
+	}
+
+	if p.Crop != nil {
+		p.Crop.applyDefaults()
+		if err := p.Crop.Validate(); err != nil {
+			return fmt.Errorf("Profile %s: %v", p.Name, err)
+		}
+	}
+
+	switch p.HDR {
+	case HDR_PRESERVE, HDR_SDR:
+	default:
+		return fmt.Errorf("Profile %s has unknown hdr mode %q, expected %s or %s", p.Name, p.HDR, HDR_PRESERVE, HDR_SDR)
+	}
+	if err := p.Tonemap.Validate(); err != nil {
+		return fmt.Errorf("Profile %s: %v", p.Name, err)
+	}
+
+	if err := validateBitrates(p.AudioBitrates); err != nil {
+		return fmt.Errorf("Profile %s: %v", p.Name, err)
+	}
+	for _, rule := range p.AudioRules {
+		if err := rule.Validate(); err != nil {
+			return fmt.Errorf("Profile %s: %v", p.Name, err)
+		}
+	}
+
+	if p.Stereo != nil {
+		p.Stereo.applyDefaults()
+		if err := p.Stereo.Validate(); err != nil {
+			return fmt.Errorf("Profile %s: %v", p.Name, err)
+		}
+	}
+
+	if p.Verify != nil {
+		p.Verify.applyDefaults()
+		if err := p.Verify.Validate(); err != nil {
+			return fmt.Errorf("Profile %s: %v", p.Name, err)
+		}
+	}
+	return nil
+}
+
+// subtitleCodec resolves copy for containers that cannot carry the usual mkv subtitle formats.
+func (p *Profile) subtitleCodec() string {
+	if p.Container == "mp4" && p.SubtitleCodec == "copy" {
+		return "mov_text"
+	}
+	return p.SubtitleCodec
+}
+
+func (p *Profile) keepSubtitles() bool {
+	return p.SubtitleCodec != "none"
+}
+
+// readConfig loads the config file, without one the flags describe a single default profile and the given libraries.
+func readConfig(configFile string, libraries []string) (*Config, error) {
+	config := &Config{}
+	if configFile != "" {
+		raw, err := ioutil.ReadFile(configFile)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := json.Unmarshal(raw, config); err != nil {
+			return nil, fmt.Errorf("Could not decode %s: %v", configFile, err)
+		}
+	}
+
+	defaults := flagProfile()
+	if config.Profiles == nil {
+		config.Profiles = make(map[string]*Profile)
+	}
+	if _, ok := config.Profiles[DEFAULT_PROFILE]; !ok {
+		config.Profiles[DEFAULT_PROFILE] = defaults
+	}
+
+	for name, profile := range config.Profiles {
+		if profile == nil {
+			return nil, fmt.Errorf("Profile %s is empty", name)
+		}
+
+		profile.Name = name
+		profile.inherit(defaults)
+		if err := profile.Validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.DefaultProfile == "" {
+		config.DefaultProfile = *profileName
+	}
+	if _, ok := config.Profiles[config.DefaultProfile]; !ok {
+		return nil, fmt.Errorf("Default profile %s is not defined", config.DefaultProfile)
+	}
+
+	config.Languages = flagLanguages().Override(config.Languages)
+
+	if config.MetadataStore == "" {
+		config.MetadataStore = *metadataStore
+	}
+	switch config.MetadataStore {
+	case STORE_JSON, STORE_BOLT:
+	default:
+		return nil, fmt.Errorf("Unknown metadata store %q, expected %s or %s", config.MetadataStore, STORE_JSON, STORE_BOLT)
+	}
+
+	if config.Retention == nil {
+		config.Retention = flagRetentionPolicy()
+	} else {
+		config.Retention.inherit(flagRetentionPolicy())
+	}
+	if err := config.Retention.Validate(); err != nil {
+		return nil, err
+	}
+
+	for _, library := range libraries {
+		config.Libraries = append(config.Libraries, &Library{Path: library})
+	}
+
+	for _, library := range config.Libraries {
+		path, err := filepath.Abs(library.Path)
+		if err != nil {
+			return nil, err
+		}
+		library.Path = path
+
+		if library.Profile == "" {
+			library.Profile = config.DefaultProfile
+		} else if _, ok := config.Profiles[library.Profile]; !ok {
+			return nil, fmt.Errorf("Library %s uses undefined profile %s", library.Path, library.Profile)
+		}
+
+		languages, err := readLanguagePolicy(library.Path, config.Languages.Override(library.Languages))
+		if err != nil {
+			return nil, fmt.Errorf("Library %s: %v", library.Path, err)
+		}
+		library.Languages = languages
+
+		if library.Retention == nil {
+			retention := *config.Retention
+			library.Retention = &retention
+		} else {
+			library.Retention.inherit(config.Retention)
+			if err := library.Retention.Validate(); err != nil {
+				return nil, fmt.Errorf("Library %s: %v", library.Path, err)
+			}
+		}
+	}
+
+	if len(config.Workers) == 0 {
+		if *workerCount < 1 {
+			// Without a worker nothing would ever drain the queue
+			return nil, fmt.Errorf("Need at least 1 worker, -workers is %d", *workerCount)
+		}
+		config.Workers = flagWorkers()
+	}
+
+	if config.Retry == nil {
+		config.Retry = flagRetryPolicy()
+	} else {
+		config.Retry.inherit(flagRetryPolicy())
+	}
+	if err := config.Retry.Validate(); err != nil {
+		return nil, err
+	}
+
+	for i, worker := range config.Workers {
+		if worker == nil {
+			return nil, fmt.Errorf("Worker %d is empty", i)
+		}
+
+		worker.ID = i
+		if err := worker.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	return config, nil
+}
+
+// ProfileFor picks the profile named in the movie directory or the closest directory above it inside the library,
+// so a series can name one profile for all of its seasons, falling back to the library profile.
+func (c *Config) ProfileFor(library *Library, movieDir string) (*Profile, error) {
+	name := library.Profile
+	for dir := movieDir; ; dir = filepath.Dir(dir) {
+		if rel, err := filepath.Rel(library.Path, dir); err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+			break
+		}
+
+		if raw, err := ioutil.ReadFile(filepath.Join(dir, PROFILE_OVERRIDE_FILE)); err == nil {
+			name = strings.TrimSpace(string(raw))
+			break
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	profile, ok := c.Profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("%s requests undefined profile %s", movieDir, name)
+	}
+	return profile, nil
+}
@@ -0,0 +1,67 @@
+//By TimTheSinner
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+/**
+ * Copyright (c) 2016 TimTheSinner All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+func TestWorkerCountValidated(t *testing.T) {
+	library, err := ioutil.TempDir("", "transcoder-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(library)
+
+	defer func(count int) { *workerCount = count }(*workerCount)
+	for _, count := range []int{0, -2} {
+		*workerCount = count
+		if _, err := readConfig("", []string{library}); err == nil {
+			t.Errorf("Expected -workers %d to be rejected", count)
+		}
+	}
+
+	*workerCount = 2
+	if config, err := readConfig("", []string{library}); err != nil || len(config.Workers) != 2 {
+		t.Errorf("Expected two workers, got %v", err)
+	}
+}
+
+func TestRetryInheritsFlags(t *testing.T) {
+	library, err := ioutil.TempDir("", "transcoder-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(library)
+
+	file := filepath.Join(library, "config.json")
+	if err := ioutil.WriteFile(file, []byte(`{"retry": {"maxAttempts": 3}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := readConfig(file, []string{library})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retry := config.Retry; retry.MaxAttempts != 3 || retry.Backoff.Duration != *retryBackoff || retry.MaxBackoff.Duration == 0 {
+		t.Errorf("Expected the flag backoff under the configured attempts, got %+v", retry)
+	}
+}
@@ -0,0 +1,165 @@
+//By TimTheSinner
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+/**
+ * Copyright (c) 2016 TimTheSinner All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+const (
+	DEFAULT_CROP_SAMPLES    = 6
+	DEFAULT_CROP_LENGTH     = 5 * time.Second
+	DEFAULT_CROP_CONFIDENCE = 0.8
+	// Luma at or below 24 of 255 counts as black, as a fraction so 10-bit sources are judged the same
+	DEFAULT_CROP_LIMIT = 24.0 / 255
+	// Bars thinner than this share of the frame are left alone, cropping them saves nothing
+	MIN_CROP_FRACTION = 0.02
+)
+
+var cropdetectLine = regexp.MustCompile(`crop=(-?\d+):(-?\d+):(-?\d+):(-?\d+)`)
+
+// CropPolicy finds black bars by running cropdetect over samples spread through the movie.
+// A crop is only applied when at least Confidence of the samples agree on it.
+type CropPolicy struct {
+	Samples    int      `json:"samples,omitempty"`
+	Length     Duration `json:"length,omitempty"`
+	Limit      float64  `json:"limit,omitempty"`
+	Confidence float64  `json:"confidence,omitempty"`
+}
+
+func flagCropPolicy() *CropPolicy {
+	if !*cropDetect {
+		return nil
+	}
+	return &CropPolicy{}
+}
+
+func (p *CropPolicy) applyDefaults() {
+	if p.Samples == 0 {
+		p.Samples = DEFAULT_CROP_SAMPLES
+	}
+	if p.Length.Duration == 0 {
+		p.Length.Duration = DEFAULT_CROP_LENGTH
+	}
+	if p.Limit == 0 {
+		p.Limit = DEFAULT_CROP_LIMIT
+	}
+	if p.Confidence == 0 {
+		p.Confidence = DEFAULT_CROP_CONFIDENCE
+	}
+}
+
+func (p *CropPolicy) Validate() error {
+	if p.Samples < 0 || p.Length.Duration < 0 {
+		return fmt.Errorf("Crop samples and length must not be negative")
+	} else if p.Limit < 0 || p.Limit >= 1 {
+		return fmt.Errorf("Crop limit must be a fraction between 0 and 1")
+	} else if p.Confidence < 0 || p.Confidence > 1 {
+		return fmt.Errorf("Crop confidence must be between 0 and 1")
+	}
+	return nil
+}
+
+// Crop is a crop filter rectangle, X and Y are the offset of the picture inside the frame.
+type Crop struct {
+	Width  int `json:"width"`
+	Height int `json:"height"`
+	X      int `json:"x"`
+	Y      int `json:"y"`
+}
+
+func (c Crop) String() string {
+	return fmt.Sprintf("%d:%d:%d:%d", c.Width, c.Height, c.X, c.Y)
+}
+
+func (c Crop) Filter() string {
+	return "crop=" + c.String()
+}
+
+// parseCropdetect returns the last rectangle cropdetect printed, which covers everything it saw in the sample.
+func parseCropdetect(stderr string) (Crop, bool) {
+	matches := cropdetectLine.FindAllStringSubmatch(stderr, -1)
+	if len(matches) == 0 {
+		return Crop{}, false
+	}
+
+	last := matches[len(matches)-1]
+	crop := Crop{atoi(last[1]), atoi(last[2]), atoi(last[3]), atoi(last[4])}
+	// An all black sample reports a negative rectangle
+	return crop, crop.Width > 0 && crop.Height > 0 && crop.X >= 0 && crop.Y >= 0
+}
+
+// stableCrop picks the rectangle most samples agree on, nil when too few agree or it would barely trim the frame.
+func (p *CropPolicy) stableCrop(detected []Crop, width, height int) *Crop {
+	if len(detected) == 0 {
+		return nil
+	}
+
+	votes := make(map[Crop]int)
+	best := detected[0]
+	for _, crop := range detected {
+		votes[crop]++
+		if votes[crop] > votes[best] {
+			best = crop
+		}
+	}
+
+	if float64(votes[best])/float64(len(detected)) < p.Confidence {
+		return nil
+	}
+
+	trimmed := float64(width*height-best.Width*best.Height) / float64(width*height)
+	if best.Width > width || best.Height > height || trimmed < MIN_CROP_FRACTION {
+		return nil
+	}
+	return &best
+}
+
+// detectCrop samples the video stream of movie with cropdetect, nil means the picture fills the frame.
+func detectCrop(ctx context.Context, executor Executor, policy *CropPolicy, worker *Worker, movie string, probe *Probe, videoStream *Stream) (*Crop, error) {
+	// Without a duration the opening of the movie is all we can sample
+	duration, _ := probe.Duration()
+	detect := fmt.Sprintf("cropdetect=limit=%s:round=2:reset=0", strconv.FormatFloat(policy.Limit, 'f', 4, 64))
+
+	detected := make([]Crop, 0, policy.Samples)
+	for _, start := range sampleOffsets(duration, policy.Samples, policy.Length.Duration) {
+		ffmpeg, ffmpegArgs := worker.command("ffmpeg",
+			"-nostdin", "-hide_banner", "-nostats",
+			"-ss", strconv.FormatFloat(start.Seconds(), 'f', 3, 64),
+			"-t", strconv.FormatFloat(policy.Length.Duration.Seconds(), 'f', 3, 64),
+			"-i", movie,
+			"-map", "0:"+strconv.Itoa(videoStream.Index),
+			"-vf", detect,
+			"-f", "null", "-")
+
+		stderr, err := executor.Run(ctx, ioutil.Discard, ffmpeg, ffmpegArgs...)
+		if err != nil {
+			return nil, err
+		}
+
+		if crop, ok := parseCropdetect(stderr); ok {
+			detected = append(detected, crop)
+		}
+	}
+	return policy.stableCrop(detected, videoStream.Width, videoStream.Height), nil
+}
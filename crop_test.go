@@ -0,0 +1,61 @@
+//By TimTheSinner
+package main
+
+import (
+	"testing"
+)
+
+/**
+ * Copyright (c) 2016 TimTheSinner All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+func TestParseCropdetect(t *testing.T) {
+	stderr := "[Parsed_cropdetect_0 @ 0x1] x1:0 x2:1919 y1:140 y2:939 w:1920 h:800 x:0 y:140 pts:1 t:0.04 crop=1920:800:0:140\n" +
+		"[Parsed_cropdetect_0 @ 0x1] x1:0 x2:1919 y1:138 y2:941 w:1920 h:804 x:0 y:138 pts:2 t:0.08 crop=1920:804:0:138\n"
+	if crop, ok := parseCropdetect(stderr); !ok || crop != (Crop{1920, 804, 0, 138}) {
+		t.Errorf("Expected the last rectangle, got %v %v", crop, ok)
+	}
+
+	if _, ok := parseCropdetect("[Parsed_cropdetect_0 @ 0x1] crop=-1904:-1072:1912:1080\n"); ok {
+		t.Error("Expected an all black sample to be ignored")
+	}
+	if _, ok := parseCropdetect("frame=  120 fps=0.0 q=-0.0 size=N/A\n"); ok {
+		t.Error("Expected no rectangle without cropdetect output")
+	}
+}
+
+func TestStableCrop(t *testing.T) {
+	policy := &CropPolicy{}
+	policy.applyDefaults()
+
+	scope := Crop{1920, 800, 0, 140}
+	dark := Crop{1920, 600, 0, 240}
+	if crop := policy.stableCrop([]Crop{scope, scope, scope, scope, dark}, 1920, 1080); crop == nil || *crop != scope {
+		t.Errorf("Expected the scope rectangle, got %v", crop)
+	}
+
+	if crop := policy.stableCrop([]Crop{scope, scope, scope, dark, dark}, 1920, 1080); crop != nil {
+		t.Errorf("Expected no crop below the confidence threshold, got %v", crop)
+	}
+
+	sliver := Crop{1920, 1076, 0, 2}
+	if crop := policy.stableCrop([]Crop{sliver, sliver}, 1920, 1080); crop != nil {
+		t.Errorf("Expected a sliver of bars to be left alone, got %v", crop)
+	}
+
+	if crop := policy.stableCrop(nil, 1920, 1080); crop != nil {
+		t.Errorf("Expected no crop without samples, got %v", crop)
+	}
+}
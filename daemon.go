@@ -0,0 +1,335 @@
+//By TimTheSinner
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**
+ * Copyright (c) 2016 TimTheSinner All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+var (
+	ErrNotInLibrary      = errors.New("Path is not inside a configured library")
+	ErrOriginalNotKept   = errors.New("The original movie was not retained")
+	ErrNotTranscoded     = errors.New("Movie has not been transcoded")
+	ErrAlreadyProcessing = errors.New("Movie is currently being processed")
+	ErrCancelled         = errors.New("Cancelled")
+)
+
+type RunningJob struct {
+	*Job
+	Worker   string    `json:"worker"`
+	Progress *Progress `json:"progress,omitempty"`
+
+	cancel    context.CancelFunc
+	cancelled bool
+}
+
+// Daemon ties the queue to the library processors and tracks what every worker is doing.
+type Daemon struct {
+	config     *Config
+	queue      *JobQueue
+	processors map[string]MovieProcessor
+	progress   *ProgressHub
+
+	lock    sync.Mutex
+	running map[uint64]*RunningJob
+	workers sync.WaitGroup
+}
+
+func NewDaemon(config *Config, queue *JobQueue, executor Executor) *Daemon {
+	daemon := &Daemon{
+		config:     config,
+		queue:      queue,
+		processors: make(map[string]MovieProcessor),
+		progress:   NewProgressHub(),
+		running:    make(map[uint64]*RunningJob),
+	}
+
+	for _, library := range config.Libraries {
+		daemon.processors[library.Path] = movieProcessor(config, library, executor)
+	}
+	return daemon
+}
+
+func (d *Daemon) work(ctx context.Context, worker *Worker) {
+	defer d.workers.Done()
+
+	for {
+		job, err := d.queue.Next(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		handle(err)
+
+		jobCtx, cancel := context.WithCancel(ctx)
+		running := &RunningJob{Job: job, Worker: worker.String(), cancel: cancel}
+		d.lock.Lock()
+		d.running[job.ID] = running
+		d.lock.Unlock()
+
+		logger := logProgress(time.Minute)
+		report := func(progress *Progress) {
+			d.lock.Lock()
+			running.Progress = progress
+			d.lock.Unlock()
+
+			logger(progress)
+			d.progress.Publish(progress)
+		}
+
+		state, err := JOB_SKIPPED, fmt.Errorf("Library %s is no longer configured", job.Library)
+		if processor, ok := d.processors[job.Library]; ok {
+			state, err = processor(jobCtx, worker, job.Path, report)
+		}
+		cancel()
+
+		d.lock.Lock()
+		delete(d.running, job.ID)
+		cancelled := running.cancelled
+		d.lock.Unlock()
+
+		if errors.Is(err, context.Canceled) && ctx.Err() != nil {
+			// Shutting down, pick this job back up on the next start
+			if err := d.queue.Requeue(job); err != nil {
+				fmt.Println("Could not requeue job", job.ID, err)
+			}
+			return
+		} else if cancelled {
+			state, err = JOB_SKIPPED, ErrCancelled
+		}
+
+		var later *retryLater
+		if errors.As(err, &later) {
+			d.requeueAt(ctx, job, later.retryAt)
+			err = later.err
+		}
+
+		if err := d.queue.Finish(job, state, err); err != nil {
+			fmt.Println("Could not record job", job.ID, err)
+		}
+	}
+}
+
+// requeueAt queues the directory of job again once the retry backoff has passed.
+// Nothing is kept across a restart, the library scan on start queues the directory anyway.
+func (d *Daemon) requeueAt(ctx context.Context, job *Job, at time.Time) {
+	go func() {
+		timer := time.NewTimer(time.Until(at))
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+			if _, err := d.queue.Enqueue(job.Library, job.Path); err != nil {
+				fmt.Println("Could not requeue", job.Path, err)
+			}
+		case <-ctx.Done():
+		}
+	}()
+}
+
+// Start runs every worker until ctx is cancelled, Wait blocks until they have all stopped.
+func (d *Daemon) Start(ctx context.Context) {
+	for _, worker := range d.config.Workers {
+		d.workers.Add(1)
+		go d.work(ctx, worker)
+	}
+}
+
+func (d *Daemon) Wait() {
+	d.workers.Wait()
+}
+
+// Cancel stops a running job, or skips it if it is still pending.
+func (d *Daemon) Cancel(id uint64) (*Job, error) {
+	d.lock.Lock()
+	if running, ok := d.running[id]; ok {
+		running.cancelled = true
+		running.cancel()
+		job := *running.Job
+		d.lock.Unlock()
+		return &job, nil
+	}
+	d.lock.Unlock()
+
+	return d.queue.Cancel(id)
+}
+
+func (d *Daemon) Running() []*RunningJob {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	running := make([]*RunningJob, 0, len(d.running))
+	for _, job := range d.running {
+		// Copy so callers can encode it while the worker keeps reporting
+		snapshot := *job
+		running = append(running, &snapshot)
+	}
+	sort.Slice(running, func(i, j int) bool { return running[i].ID < running[j].ID })
+	return running
+}
+
+// overlapsRunning reports whether a running job covers movieDir, or a directory in or above it.
+func (d *Daemon) overlapsRunning(movieDir string) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	for _, job := range d.running {
+		if pathsOverlap(job.Path, movieDir) {
+			return true
+		}
+	}
+	return false
+}
+
+// pathsOverlap is true when a and b are the same directory or one holds the other.
+func pathsOverlap(a, b string) bool {
+	return isWithin(a, b) || isWithin(b, a)
+}
+
+func isWithin(parent, path string) bool {
+	rel, err := filepath.Rel(parent, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// libraryFor resolves a movie directory, or a file inside one, to the library that holds it.
+func (d *Daemon) libraryFor(path string) (*Library, string, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, "", err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, "", err
+	} else if !info.IsDir() {
+		path = filepath.Dir(path)
+	}
+
+	for _, library := range d.config.Libraries {
+		root, err := filepath.Abs(library.Path)
+		if err != nil {
+			return nil, "", err
+		}
+
+		if rel, err := filepath.Rel(root, path); err == nil && rel != "." && !strings.HasPrefix(rel, "..") {
+			return library, path, nil
+		}
+	}
+	return nil, "", ErrNotInLibrary
+}
+
+func (d *Daemon) Enqueue(path string) (*Job, error) {
+	library, movieDir, err := d.libraryFor(path)
+	if err != nil {
+		return nil, err
+	}
+	return d.queue.Enqueue(library.Path, movieDir)
+}
+
+// Rerun puts the retained originals back in place of everything transcoded under path and queues it again.
+func (d *Daemon) Rerun(path string) (*Job, error) {
+	library, movieDir, err := d.libraryFor(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if d.overlapsRunning(movieDir) {
+		return nil, ErrAlreadyProcessing
+	}
+
+	transcodes, err := library.store.Query(MetadataQuery{})
+	if err != nil {
+		return nil, err
+	}
+
+	found := false
+	for _, meta := range transcodes {
+		dir := transcodeDir(library.Path, meta)
+		if rel, err := filepath.Rel(movieDir, dir); err != nil || strings.HasPrefix(rel, "..") {
+			continue
+		}
+		found = true
+
+		if meta.Failure != nil {
+			// A rerun is an explicit request to try a movie the retry policy gave up on
+			if err := clearFailure(library.store, meta.Movie); err != nil {
+				return nil, err
+			}
+			if meta.TranscodedMovie == "" {
+				continue
+			}
+		}
+
+		if err := d.restoreIdle(movieDir, dir, meta); err != nil {
+			return nil, fmt.Errorf("%s: %w", meta.Movie, err)
+		}
+	}
+
+	if !found {
+		return nil, ErrNotTranscoded
+	}
+	return d.queue.Enqueue(library.Path, movieDir)
+}
+
+// restoreIdle puts one original back under the movie lock, once more making sure no worker picked up movieDir meanwhile.
+// The lock keeps a worker that claims the directory now from transcoding the movie halfway through the restore.
+func (d *Daemon) restoreIdle(movieDir, dir string, meta *Transcode) error {
+	lock, err := NewLockfile(filepath.Join(dir, "transcoding.lck"))
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	if d.overlapsRunning(movieDir) {
+		return ErrAlreadyProcessing
+	}
+	return restoreOriginal(dir, meta)
+}
+
+func restoreOriginal(movieDir string, meta *Transcode) error {
+	if !strings.HasSuffix(meta.OriginalMovie, "-orig") || meta.OriginalDiscarded != nil {
+		return ErrOriginalNotKept
+	}
+
+	original := filepath.Join(movieDir, meta.OriginalMovie)
+	if _, err := os.Stat(original); os.IsNotExist(err) {
+		return ErrOriginalNotKept
+	} else if err != nil {
+		return err
+	}
+
+	if err := removeExtractedSubtitles(movieDir, meta); err != nil {
+		return err
+	}
+
+	restored := strings.TrimSuffix(original, "-orig")
+	transcoded := filepath.Join(movieDir, meta.TranscodedMovie)
+	if transcoded != restored {
+		if err := os.Remove(transcoded); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(original, restored)
+}
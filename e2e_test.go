@@ -0,0 +1,850 @@
+//By TimTheSinner
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+/**
+ * Copyright (c) 2016 TimTheSinner All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+const E2E_TIMEOUT = 10 * time.Second
+
+// e2e is a daemon over a temporary library whose ffmpeg and ffprobe are scripted by a FakeExecutor.
+type e2e struct {
+	t       *testing.T
+	root    string
+	library string
+	fake    *FakeExecutor
+	config  *Config
+	queue   *JobQueue
+	daemon  *Daemon
+	cancel  context.CancelFunc
+}
+
+func newE2E(t *testing.T) *e2e {
+	root, err := ioutil.TempDir("", "transcoder-e2e")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	library := filepath.Join(root, "library")
+	if err := os.Mkdir(library, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := readConfig("", []string{library})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := openMetadataStores(config); err != nil {
+		t.Fatal(err)
+	}
+
+	queue, err := OpenJobQueue(filepath.Join(root, QUEUE_FILE))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fake := NewFakeExecutor()
+	e := &e2e{t: t, root: root, library: config.Libraries[0].Path, fake: fake, config: config, queue: queue}
+	t.Cleanup(e.close)
+	return e
+}
+
+// start runs the daemon, after the test has finished scripting the fake and the profile.
+func (e *e2e) start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	e.cancel = cancel
+	e.daemon = NewDaemon(e.config, e.queue, e.fake)
+	e.daemon.Start(ctx)
+}
+
+func (e *e2e) close() {
+	if e.cancel != nil {
+		e.cancel()
+		e.daemon.Wait()
+	}
+	e.queue.Close()
+	closeMetadataStores(e.config.Libraries)
+	os.RemoveAll(e.root)
+}
+
+// movie creates a sparse file large enough to be picked up as media.
+func (e *e2e) movie(rel string) string {
+	path := filepath.Join(e.library, filepath.FromSlash(rel))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		e.t.Fatal(err)
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	defer file.Close()
+
+	if err := file.Truncate(MIN_FILE_SIZE + 1024*1024); err != nil {
+		e.t.Fatal(err)
+	}
+	return path
+}
+
+func (e *e2e) enqueue(rel string) *Job {
+	job, err := e.daemon.Enqueue(filepath.Join(e.library, filepath.FromSlash(rel)))
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	return job
+}
+
+// idle waits for every queued job to finish.
+func (e *e2e) idle() {
+	deadline := time.Now().Add(E2E_TIMEOUT)
+	for time.Now().Before(deadline) {
+		jobs, err := e.queue.Jobs(JOB_PENDING, JOB_RUNNING)
+		if err != nil {
+			e.t.Fatal(err)
+		} else if len(jobs) == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	e.t.Fatal("Timed out waiting for the queue to drain")
+}
+
+func (e *e2e) job(id uint64) *Job {
+	job, err := e.queue.Job(id)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	return job
+}
+
+// verifyingProfile turns on verification with its defaults for the default profile.
+func (e *e2e) verifyingProfile() *Profile {
+	verify := &VerifyPolicy{}
+	verify.applyDefaults()
+	profile := e.config.Profiles[DEFAULT_PROFILE]
+	profile.Verify = verify
+	return profile
+}
+
+func (e *e2e) metadata(key string) *Transcode {
+	meta, ok, err := e.config.Libraries[0].store.Get(key)
+	if err != nil {
+		e.t.Fatal(err)
+	} else if !ok {
+		e.t.Fatalf("No metadata recorded for %s", key)
+	}
+	return meta
+}
+
+func assertExists(t *testing.T, path string) {
+	t.Helper()
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("Expected %s to exist: %v", path, err)
+	}
+}
+
+func assertMissing(t *testing.T, path string) {
+	t.Helper()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Expected %s to be gone: %v", path, err)
+	}
+}
+
+func assertTranscoded(t *testing.T, path string) {
+	t.Helper()
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	} else if !strings.HasPrefix(string(raw), FAKE_TRANSCODE_MARKER) {
+		t.Errorf("Expected %s to be the transcode", path)
+	}
+}
+
+func TestTranscodeReplacesOriginal(t *testing.T) {
+	e := newE2E(t)
+	original := e.movie("Movie/Movie.avi")
+	e.start()
+
+	job := e.enqueue("Movie")
+	e.idle()
+
+	if job := e.job(job.ID); job.State != JOB_DONE {
+		t.Fatalf("Job finished %s: %s", job.State, job.Error)
+	}
+
+	assertTranscoded(t, filepath.Join(e.library, "Movie", "Movie.mkv"))
+	assertExists(t, original+"-orig")
+	assertMissing(t, original)
+	assertMissing(t, filepath.Join(e.library, "Movie", "transcode-Movie.mkv"))
+
+	meta := e.metadata("Movie/Movie")
+	if meta.Status() != STATUS_TRANSCODED || meta.OriginalMovie != "Movie.avi-orig" || meta.TranscodedMovie != "Movie.mkv" {
+		t.Errorf("Unexpected metadata %+v", meta)
+	}
+	if meta.OriginalWidth != 3840 || meta.TranscodedWidth != 1920 || meta.TranscodedCodec != "hevc" {
+		t.Errorf("Unexpected stream metadata %+v", meta)
+	}
+
+	transcodes := e.fake.Transcodes()
+	if len(transcodes) != 1 {
+		t.Fatalf("Expected a single ffmpeg run, got %d", len(transcodes))
+	}
+	run := transcodes[0]
+	if !run.Has("-vf", "scale=1920:-2") || !run.Has("-c:v", e.config.Profiles[DEFAULT_PROFILE].VideoCodec) || !run.Has("-c:a:0", "libopus") {
+		t.Errorf("Unexpected ffmpeg arguments %v", run.Args)
+	}
+	if !run.Has("-map", "0:1") || run.Has("-map", "0:2") {
+		t.Errorf("Expected only the english audio to be mapped %v", run.Args)
+	}
+
+	// Running again finds nothing left to do
+	e.enqueue("Movie")
+	e.idle()
+	if len(e.fake.Transcodes()) != 1 {
+		t.Errorf("Transcoded movie was transcoded again")
+	}
+}
+
+func TestFFmpegFailureIsRecorded(t *testing.T) {
+	e := newE2E(t)
+	original := e.movie("Broken/Broken.mkv")
+	e.fake.FFmpeg = []FakeFFmpeg{{ExitStatus: 187, Stderr: "Conversion failed!"}}
+	e.start()
+
+	job := e.enqueue("Broken")
+	e.idle()
+
+	if job := e.job(job.ID); job.State != JOB_FAILED || !strings.Contains(job.Error, "ffmpeg") {
+		t.Errorf("Expected the job to fail in ffmpeg, got %s: %s", job.State, job.Error)
+	}
+
+	info, err := os.Stat(original)
+	if err != nil || info.Size() != MIN_FILE_SIZE+1024*1024 {
+		t.Errorf("Original was disturbed: %v", err)
+	}
+	assertMissing(t, original+"-orig")
+	assertMissing(t, filepath.Join(e.library, "Broken", "transcode-Broken.mkv"))
+
+	meta := e.metadata("Broken/Broken")
+	if meta.Status() != STATUS_FAILED {
+		t.Fatalf("Expected a failure to be recorded %+v", meta)
+	}
+	failure := meta.Failure
+	if failure.Reason != REASON_FFMPEG || failure.ExitStatus != 187 || failure.Stderr != "Conversion failed!" || failure.Attempts != 1 {
+		t.Errorf("Unexpected failure %+v", failure)
+	}
+
+	// The retry policy holds the movie back until the backoff has passed
+	retry := e.enqueue("Broken")
+	e.idle()
+	if job := e.job(retry.ID); job.State != JOB_SKIPPED || !strings.Contains(job.Error, "Not retrying Broken.mkv until") {
+		t.Errorf("Expected the backed off job to be skipped, got %s: %s", job.State, job.Error)
+	}
+	if runs := len(e.fake.Transcodes()); runs != 1 {
+		t.Errorf("Expected the retry to be backed off, ffmpeg ran %d times", runs)
+	}
+	if attempts := e.metadata("Broken/Broken").Failure.Attempts; attempts != 1 {
+		t.Errorf("Expected a single attempt, got %d", attempts)
+	}
+}
+
+func TestSwappedTranscodeIsAlwaysRecorded(t *testing.T) {
+	e := newE2E(t)
+	original := e.movie("Movie/Movie.mkv")
+	// The transcode is in place before ffprobe turns out unable to read it
+	e.fake.Transcoded = "not json"
+	e.start()
+
+	job := e.enqueue("Movie")
+	e.idle()
+
+	if job := e.job(job.ID); job.State != JOB_DONE {
+		t.Errorf("Job finished %s: %s", job.State, job.Error)
+	}
+	assertTranscoded(t, original)
+	meta := e.metadata("Movie/Movie")
+	if meta.Status() != STATUS_TRANSCODED || meta.Failure != nil || meta.TranscodedSize == 0 {
+		t.Errorf("Expected the swap to be recorded as a transcode %+v", meta)
+	}
+}
+
+func TestKeptOriginalIsNeverOverwritten(t *testing.T) {
+	e := newE2E(t)
+	e.movie("Movie/Movie.mkv")
+	kept := filepath.Join(e.library, "Movie", "Movie.mkv-orig")
+	if err := ioutil.WriteFile(kept, []byte("the real original"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	e.start()
+
+	job := e.enqueue("Movie")
+	e.idle()
+
+	if job := e.job(job.ID); job.State != JOB_FAILED || !strings.Contains(job.Error, "already exists") {
+		t.Errorf("Expected the swap to be refused, got %s: %s", job.State, job.Error)
+	}
+	if raw, err := ioutil.ReadFile(kept); err != nil || string(raw) != "the real original" {
+		t.Errorf("The kept original was overwritten: %v", err)
+	}
+	assertMissing(t, filepath.Join(e.library, "Movie", "transcode-Movie.mkv"))
+}
+
+func TestRetriesAreRequeuedUntilGivenUp(t *testing.T) {
+	e := newE2E(t)
+	e.movie("Broken/Broken.mkv")
+	e.fake.FFmpeg = []FakeFFmpeg{{ExitStatus: 187, Stderr: "Conversion failed!"}}
+	e.config.Retry = &RetryPolicy{MaxAttempts: 2, Backoff: Duration{200 * time.Millisecond}}
+	e.start()
+
+	// Nothing but the backoff queues the second attempt
+	e.enqueue("Broken")
+	deadline := time.Now().Add(E2E_TIMEOUT)
+	for len(e.fake.Transcodes()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	e.idle()
+	if attempts := e.metadata("Broken/Broken").Failure.Attempts; attempts != 2 {
+		t.Fatalf("Expected the movie to be retried once the backoff passed, got %d attempts", attempts)
+	}
+
+	job := e.enqueue("Broken")
+	e.idle()
+	if job := e.job(job.ID); job.State != JOB_FAILED || !strings.Contains(job.Error, "Gave up on Broken.mkv after 2 attempts") {
+		t.Errorf("Expected the job to fail once the policy gave up, got %s: %s", job.State, job.Error)
+	}
+	if runs := len(e.fake.Transcodes()); runs != 2 {
+		t.Errorf("Expected no attempt after giving up, ffmpeg ran %d times", runs)
+	}
+}
+
+func TestSeriesEpisodesAreTrackedSeparately(t *testing.T) {
+	e := newE2E(t)
+	e.movie("Show/Season 1/Show.S01E01.mkv")
+	e.movie("Show/Season 1/Show.S01E02.mkv")
+	e.start()
+
+	job := e.enqueue("Show")
+	e.idle()
+
+	if job := e.job(job.ID); job.State != JOB_DONE {
+		t.Fatalf("Job finished %s: %s", job.State, job.Error)
+	}
+
+	for i, key := range []string{"Show/Season 1/Show.S01E01", "Show/Season 1/Show.S01E02"} {
+		meta := e.metadata(key)
+		if meta.Episode == nil || meta.Episode.Series != "Show" || meta.Episode.Season != 1 || meta.Episode.Episode != i+1 {
+			t.Errorf("Unexpected episode for %s: %+v", key, meta.Episode)
+		}
+		assertTranscoded(t, filepath.Join(e.library, filepath.FromSlash(key)+".mkv"))
+	}
+
+	transcodes := e.fake.Transcodes()
+	if len(transcodes) != 2 {
+		t.Fatalf("Expected an ffmpeg run per episode, got %d", len(transcodes))
+	}
+	if !transcodes[0].Has("-metadata:s:v", "title=Show S01E01") || !transcodes[1].Has("-metadata:s:v", "title=Show S01E02") {
+		t.Errorf("Episodes were not titled %v", transcodes)
+	}
+}
+
+func TestProgressIsPublished(t *testing.T) {
+	e := newE2E(t)
+	original := e.movie("Movie/Movie.mkv")
+	e.start()
+
+	progress := e.daemon.progress.Subscribe()
+	defer e.daemon.progress.Unsubscribe(progress)
+
+	e.enqueue("Movie")
+	e.idle()
+
+	var updates []*Progress
+	for len(progress) > 0 {
+		updates = append(updates, <-progress)
+	}
+
+	if len(updates) != 3 {
+		t.Fatalf("Expected three progress updates, got %d", len(updates))
+	}
+	if half := updates[0]; half.Movie != original || half.Worker != "worker-0" || half.Percent != float64(100)/3 || half.Done {
+		t.Errorf("Unexpected first update %+v", half)
+	}
+	if last := updates[len(updates)-1]; !last.Done || last.Percent != 100 {
+		t.Errorf("Expected the last update to finish the encode %+v", last)
+	}
+}
+
+func TestVerificationRejectsPoorEncode(t *testing.T) {
+	e := newE2E(t)
+	original := e.movie("Movie/Movie.mkv")
+	e.fake.Quality = FAKE_QUALITY_POOR
+
+	e.verifyingProfile()
+	e.start()
+
+	job := e.enqueue("Movie")
+	e.idle()
+
+	if job := e.job(job.ID); job.State != JOB_FAILED {
+		t.Errorf("Expected verification to fail the job, got %s", job.State)
+	}
+
+	assertExists(t, original)
+	assertMissing(t, original+"-orig")
+	assertMissing(t, filepath.Join(e.library, "Movie", "transcode-Movie.mkv"))
+
+	if failure := e.metadata("Movie/Movie").Failure; failure == nil || failure.Reason != REASON_VERIFY || !strings.Contains(failure.Error, "SSIM") {
+		t.Errorf("Expected a verify failure, got %+v", failure)
+	}
+}
+
+func TestCancelRunningJob(t *testing.T) {
+	e := newE2E(t)
+	original := e.movie("Movie/Movie.mkv")
+	started := make(chan struct{})
+	e.fake.FFmpeg = []FakeFFmpeg{{Progress: []int64{60000000}, Block: true, Started: started}}
+	e.start()
+
+	job := e.enqueue("Movie")
+	select {
+	case <-started:
+	case <-time.After(E2E_TIMEOUT):
+		t.Fatal("ffmpeg never started")
+	}
+
+	if _, err := e.daemon.Cancel(job.ID); err != nil {
+		t.Fatal(err)
+	}
+	e.idle()
+
+	if job := e.job(job.ID); job.State != JOB_SKIPPED || job.Error != ErrCancelled.Error() {
+		t.Errorf("Expected the job to be cancelled, got %s: %s", job.State, job.Error)
+	}
+
+	assertExists(t, original)
+	assertMissing(t, filepath.Join(e.library, "Movie", "transcode-Movie.mkv"))
+	if _, ok, err := e.config.Libraries[0].store.Get("Movie/Movie"); err != nil || ok {
+		t.Errorf("A cancelled transcode should not be recorded: %v", err)
+	}
+}
+
+func TestOverlappingJobsRunInTurn(t *testing.T) {
+	e := newE2E(t)
+	e.movie("Show/Season 1/Show.S01E01.mkv")
+	e.movie("Show/Season 2/Show.S02E01.mkv")
+	e.config.Workers = append(e.config.Workers, &Worker{ID: len(e.config.Workers)})
+	started := make(chan struct{})
+	e.fake.FFmpeg = []FakeFFmpeg{{Block: true, Started: started}, {Progress: []int64{1800000000, 3600000000}}}
+	e.start()
+
+	// The watcher queues the season a file landed in while a scan queues the whole show
+	season := e.enqueue("Show/Season 1")
+	select {
+	case <-started:
+	case <-time.After(E2E_TIMEOUT):
+		t.Fatal("ffmpeg never started")
+	}
+	show := e.enqueue("Show")
+
+	// A season queued while its show is pending is covered by the show's job
+	if job := e.enqueue("Show/Season 2"); job.ID != show.ID {
+		t.Errorf("Expected the season to join the pending show job %d, got %d", show.ID, job.ID)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if job := e.job(show.ID); job.State != JOB_PENDING {
+		t.Errorf("The show started while its season was running: %s", job.State)
+	}
+
+	if _, err := e.daemon.Cancel(season.ID); err != nil {
+		t.Fatal(err)
+	}
+	e.idle()
+
+	if job := e.job(show.ID); job.State != JOB_DONE {
+		t.Errorf("Job finished %s: %s", job.State, job.Error)
+	}
+	assertTranscoded(t, filepath.Join(e.library, "Show", "Season 1", "Show.S01E01.mkv"))
+	assertTranscoded(t, filepath.Join(e.library, "Show", "Season 2", "Show.S02E01.mkv"))
+}
+
+func TestQueueCommandAsksTheDaemon(t *testing.T) {
+	e := newE2E(t)
+	e.movie("Movie/Movie.mkv")
+	e.start()
+	job := e.enqueue("Movie")
+	e.idle()
+
+	server := httptest.NewServer(NewAPI(e.daemon))
+	defer server.Close()
+
+	// The daemon holds the queue database, listing it has to go through the API
+	e.config.HTTP = strings.TrimPrefix(server.URL, "http://")
+	jobs, err := listJobs(e.config)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(jobs) != 1 || jobs[0].ID != job.ID || jobs[0].State != JOB_DONE {
+		t.Errorf("Unexpected jobs %+v", jobs)
+	}
+
+	if url := apiURL(":8080", "/api/jobs"); url != "http://localhost:8080/api/jobs" {
+		t.Errorf("Expected a listen address to be reached on localhost, got %s", url)
+	}
+}
+
+func TestRerunRestoresOriginal(t *testing.T) {
+	e := newE2E(t)
+	original := e.movie("Movie/Movie.mkv")
+	e.start()
+
+	e.enqueue("Movie")
+	e.idle()
+	assertTranscoded(t, original)
+
+	job, err := e.daemon.Rerun(filepath.Join(e.library, "Movie"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.idle()
+
+	if job := e.job(job.ID); job.State != JOB_DONE {
+		t.Errorf("Job finished %s: %s", job.State, job.Error)
+	}
+	if runs := len(e.fake.Transcodes()); runs != 2 {
+		t.Errorf("Expected the restored original to be transcoded again, ffmpeg ran %d times", runs)
+	}
+	assertTranscoded(t, original)
+	assertExists(t, original+"-orig")
+	assertMissing(t, filepath.Join(e.library, "Movie", "transcoding.lck"))
+}
+
+func TestRerunRefusesOverlappingJobs(t *testing.T) {
+	e := newE2E(t)
+	e.movie("Show/Season 1/Show.S01E01.mkv")
+	started := make(chan struct{})
+	e.fake.FFmpeg = []FakeFFmpeg{{Block: true, Started: started}}
+	e.start()
+
+	job := e.enqueue("Show/Season 1")
+	select {
+	case <-started:
+	case <-time.After(E2E_TIMEOUT):
+		t.Fatal("ffmpeg never started")
+	}
+
+	// The season is part of the show, and the episode is part of the running season
+	for _, rel := range []string{"Show", "Show/Season 1", "Show/Season 1/Show.S01E01.mkv"} {
+		if _, err := e.daemon.Rerun(filepath.Join(e.library, filepath.FromSlash(rel))); err != ErrAlreadyProcessing {
+			t.Errorf("Expected rerunning %s to be refused, got %v", rel, err)
+		}
+	}
+
+	if _, err := e.daemon.Cancel(job.ID); err != nil {
+		t.Fatal(err)
+	}
+	e.idle()
+}
+
+func TestCancelledProbeIsNotAFailure(t *testing.T) {
+	e := newE2E(t)
+	movie := e.movie("Movie/Movie.mkv")
+
+	// Shutting down while ffprobe runs
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := processFile(ctx, e.fake, e.config, e.config.Libraries[0], e.config.Workers[0], movie, nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected the probe to be cancelled, got %v", err)
+	}
+
+	if _, ok, err := e.config.Libraries[0].store.Get("Movie/Movie"); err != nil || ok {
+		t.Errorf("A cancelled probe should not be recorded: %v", err)
+	}
+}
+
+func TestSidecarSubtitlesAreMuxed(t *testing.T) {
+	e := newE2E(t)
+	e.movie("Movie/Movie.mkv")
+	for _, sidecar := range []string{"Movie.en.srt", "Movie.forced.srt", "Movie.fre.srt", "Movie.eng.sdh.ass"} {
+		if err := ioutil.WriteFile(filepath.Join(e.library, "Movie", sidecar), []byte(FAKE_SUBTITLE), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e.start()
+
+	e.enqueue("Movie")
+	e.idle()
+
+	transcodes := e.fake.Transcodes()
+	if len(transcodes) != 1 {
+		t.Fatalf("Expected a single ffmpeg run, got %d", len(transcodes))
+	}
+	run := transcodes[0]
+
+	// The french sidecar is not a wanted language, the rest follow the embedded english subtitle
+	dir := filepath.Join(e.library, "Movie")
+	for i, sidecar := range []string{"Movie.en.srt", "Movie.eng.sdh.ass", "Movie.forced.srt"} {
+		if !run.Has("-i", filepath.Join(dir, sidecar)) {
+			t.Errorf("Expected %s to be an input %v", sidecar, run.Args)
+		}
+		if !run.Has("-map", strconv.Itoa(i+1)+":0") || !run.Has("-metadata:s:s:"+strconv.Itoa(i+1), "language=eng") {
+			t.Errorf("Expected %s to be mapped as english %v", sidecar, run.Args)
+		}
+	}
+	if run.Has("-i", filepath.Join(dir, "Movie.fre.srt")) {
+		t.Errorf("Unwanted language was muxed %v", run.Args)
+	}
+	if !run.Has("-disposition:s:1", "0") || !run.Has("-disposition:s:2", "hearing_impaired") || !run.Has("-disposition:s:3", "forced") || !run.Has("-metadata:s:s:3", "title=Forced") {
+		t.Errorf("Sidecars were not flagged %v", run.Args)
+	}
+
+	if sidecars := e.metadata("Movie/Movie").SidecarSubtitles; len(sidecars) != 3 {
+		t.Errorf("Expected the muxed sidecars to be recorded, got %v", sidecars)
+	}
+}
+
+func TestEmbeddedSubtitlesAreExtracted(t *testing.T) {
+	e := newE2E(t)
+	e.movie("Movie/Movie.avi")
+	// Taken already, the extracted english subtitle is numbered instead of replacing it
+	if err := ioutil.WriteFile(filepath.Join(e.library, "Movie", "Movie.eng.srt"), []byte("downloaded"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	e.fake.Probes[""] = `{
+		"format": {"duration": "5400.000000"},
+		"streams": [
+			{"index": 0, "codec_name": "h264", "codec_type": "video", "width": 1920, "height": 1080},
+			{"index": 1, "codec_name": "ac3", "codec_type": "audio", "channels": 6, "tags": {"language": "eng"}},
+			{"index": 2, "codec_name": "hdmv_pgs_subtitle", "codec_type": "subtitle", "tags": {"language": "eng"}},
+			{"index": 3, "codec_name": "ass", "codec_type": "subtitle", "disposition": {"forced": 1}, "tags": {"language": "eng"}},
+			{"index": 4, "codec_name": "subrip", "codec_type": "subtitle", "tags": {"language": "eng"}}
+		]
+	}`
+	e.config.Profiles[DEFAULT_PROFILE].ExtractSubtitles = true
+	e.start()
+
+	e.enqueue("Movie")
+	e.idle()
+
+	dir := filepath.Join(e.library, "Movie")
+	for _, name := range []string{"Movie.eng.forced.srt", "Movie.eng.2.srt"} {
+		if raw, err := ioutil.ReadFile(filepath.Join(dir, name)); err != nil || string(raw) != FAKE_SUBTITLE {
+			t.Errorf("Expected %s to be extracted: %v", name, err)
+		}
+	}
+	if raw, err := ioutil.ReadFile(filepath.Join(dir, "Movie.eng.srt")); err != nil || string(raw) != "downloaded" {
+		t.Errorf("Existing sidecar was replaced: %v", err)
+	}
+	assertMissing(t, filepath.Join(dir, "transcode-Movie.eng.forced.srt"))
+
+	// The downloaded Movie.eng.srt was muxed as a sidecar and is not extracted back out
+	subtitles := e.metadata("Movie/Movie").ExtractedSubtitles
+	if len(subtitles) != 3 {
+		t.Fatalf("Expected every embedded subtitle to be recorded, got %d", len(subtitles))
+	}
+	if pgs := subtitles[0]; pgs.Stream != 2 || pgs.File != "" || !strings.Contains(pgs.Error, "bitmap") {
+		t.Errorf("Expected PGS to be reported as not extractable %+v", pgs)
+	}
+	if forced := subtitles[1]; forced.File != "Movie.eng.forced.srt" || !forced.Forced || forced.Error != "" {
+		t.Errorf("Unexpected forced subtitle %+v", forced)
+	}
+	if full := subtitles[2]; full.File != "Movie.eng.2.srt" || full.Language != "eng" || full.Error != "" {
+		t.Errorf("Unexpected subtitle %+v", full)
+	}
+
+	if err := removeExtractedSubtitles(dir, e.metadata("Movie/Movie")); err != nil {
+		t.Fatal(err)
+	}
+	assertMissing(t, filepath.Join(dir, "Movie.eng.forced.srt"))
+	assertExists(t, filepath.Join(dir, "Movie.eng.srt"))
+}
+
+func TestHDRSources(t *testing.T) {
+	e := newE2E(t)
+	e.movie("Preserved/Preserved.mkv")
+	e.movie("Tonemapped/Tonemapped.mkv")
+	e.fake.Probes[""] = `{"format": {"duration": "5400.000000"}, "streams": [` + HDR10_STREAM + `,
+		{"index": 1, "codec_name": "truehd", "codec_type": "audio", "channels": 8, "tags": {"language": "eng"}},
+		{"index": 2, "codec_name": "subrip", "codec_type": "subtitle", "tags": {"language": "eng"}}]}`
+
+	e.verifyingProfile()
+	// The default profile encodes 8-bit for a pi, only a 10-bit profile keeps HDR
+	e.config.Profiles["hdr"] = &Profile{Name: "hdr", VideoCodec: "libx265", PixFmt: "yuv420p10le"}
+	e.config.Profiles["hdr"].inherit(e.config.Profiles[DEFAULT_PROFILE])
+	if err := ioutil.WriteFile(filepath.Join(e.library, "Preserved", PROFILE_OVERRIDE_FILE), []byte("hdr"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	e.start()
+
+	e.enqueue("Preserved")
+	e.enqueue("Tonemapped")
+	e.idle()
+
+	transcodes := e.fake.Transcodes()
+	if len(transcodes) != 2 {
+		t.Fatalf("Expected two ffmpeg runs, got %d", len(transcodes))
+	}
+
+	preserved := transcodes[0]
+	if !preserved.Has("-vf", "scale=1920:-2") || !preserved.Has("-pix_fmt", "yuv420p10le") || !preserved.Has("-color_trc", "smpte2084") ||
+		!strings.Contains(preserved.Arg("-x265-params"), "master-display=") {
+		t.Errorf("Expected HDR10 to be preserved %v", preserved.Args)
+	}
+	if meta := e.metadata("Preserved/Preserved"); meta.OriginalHDR != HDR10 || meta.Tonemapped != "" {
+		t.Errorf("Unexpected metadata %+v", meta)
+	}
+
+	tonemapped := transcodes[1]
+	if vf := tonemapped.Arg("-vf"); !strings.HasPrefix(vf, "scale=1920:-2,zscale=") || !strings.Contains(vf, "tonemap=tonemap=hable") {
+		t.Errorf("Expected the tonemap to follow the scale %s", vf)
+	}
+	if !tonemapped.Has("-c:v", "hevc_amf") || !tonemapped.Has("-pix_fmt", "yuv420p") || !tonemapped.Has("-color_trc", "bt709") {
+		t.Errorf("Expected the default profile to encode SDR %v", tonemapped.Args)
+	}
+	if meta := e.metadata("Tonemapped/Tonemapped"); meta.OriginalHDR != HDR10 || meta.Tonemapped != "hable" {
+		t.Errorf("Unexpected metadata %+v", meta)
+	}
+
+	// The original is compared in SDR too, so the encode is not rejected for the tonemapping itself
+	comparisons := 0
+	for _, run := range e.fake.Runs {
+		graph := run.Arg("-lavfi")
+		if graph == "" {
+			continue
+		}
+
+		comparisons++
+		reference := graph[strings.Index(graph, "[1:v:0]"):]
+		reference = reference[:strings.Index(reference, ";")]
+		if tonemapped := strings.Contains(reference, "tonemap=tonemap=hable"); tonemapped != strings.Contains(run.Arg("-i"), "Tonemapped") {
+			t.Errorf("Expected only the tonemapped original to be tonemapped before comparing %s", graph)
+		}
+	}
+	if comparisons == 0 {
+		t.Error("Expected the encodes to be verified")
+	}
+}
+
+func TestBlackBarsCropped(t *testing.T) {
+	e := newE2E(t)
+	e.movie("Movie/Movie.mkv")
+
+	// One dark scene reports a tighter rectangle, the other five samples outvote it
+	scope := "[Parsed_cropdetect_0 @ 0x1] x1:0 x2:3839 y1:282 y2:1877 w:3840 h:1584 x:0 y:288 pts:1 t:0.04 crop=3840:1584:0:288\n" +
+		"[Parsed_cropdetect_0 @ 0x1] x1:0 x2:3839 y1:280 y2:1879 w:3840 h:1600 x:0 y:280 pts:2 t:0.08 crop=3840:1600:0:280\n"
+	dark := "[Parsed_cropdetect_0 @ 0x1] x1:0 x2:3839 y1:480 y2:1679 w:3840 h:1200 x:0 y:480 pts:1 t:0.04 crop=3840:1200:0:480\n"
+	e.fake.Crops = []string{scope, scope, dark, scope, scope, scope}
+
+	crop := &CropPolicy{}
+	crop.applyDefaults()
+	e.verifyingProfile().Crop = crop
+	e.start()
+
+	e.enqueue("Movie")
+	e.idle()
+
+	transcodes := e.fake.Transcodes()
+	if len(transcodes) != 1 {
+		t.Fatalf("Expected one ffmpeg run, got %d", len(transcodes))
+	}
+	if vf := transcodes[0].Arg("-vf"); vf != "crop=3840:1600:0:280,scale=1920:-2" {
+		t.Errorf("Expected the crop ahead of the scale, got %s", vf)
+	}
+
+	detections, comparisons := 0, 0
+	for _, run := range e.fake.Runs {
+		if strings.HasPrefix(run.Arg("-vf"), "cropdetect=") {
+			detections++
+		} else if graph := run.Arg("-lavfi"); graph != "" {
+			comparisons++
+			if !strings.Contains(graph, "[1:v:0]crop=3840:1600:0:280,scale=") {
+				t.Errorf("Expected the original to be cropped before comparing %s", graph)
+			}
+		}
+	}
+	if detections != DEFAULT_CROP_SAMPLES || comparisons == 0 {
+		t.Errorf("Expected %d cropdetect samples and a verification, got %d and %d", DEFAULT_CROP_SAMPLES, detections, comparisons)
+	}
+
+	if meta := e.metadata("Movie/Movie"); meta.Crop == nil || *meta.Crop != (Crop{3840, 1600, 0, 280}) || meta.VideoFilters != "crop=3840:1600:0:280,scale=1920:-2" {
+		t.Errorf("Expected the crop to be recorded %+v", meta.Crop)
+	}
+}
+
+func TestInterlacedSources(t *testing.T) {
+	e := newE2E(t)
+	e.movie("Broadcast/Broadcast.ts")
+	e.movie("Film/Film.m2ts")
+	for name, fieldOrder := range map[string]string{"Broadcast.ts": "tt", "Film.m2ts": "unknown"} {
+		e.fake.Probes[name] = `{"format": {"duration": "5400.000000"}, "streams": [
+			{"index": 0, "codec_name": "mpeg2video", "codec_type": "video", "width": 1920, "height": 1080, "pix_fmt": "yuv420p", "field_order": "` + fieldOrder + `"},
+			{"index": 1, "codec_name": "ac3", "codec_type": "audio", "channels": 2, "tags": {"language": "eng"}},
+			{"index": 2, "codec_name": "subrip", "codec_type": "subtitle", "tags": {"language": "eng"}}]}`
+	}
+	scripts := make([]string, 0, 2*DEFAULT_DEINTERLACE_SAMPLES)
+	for i := 0; i < DEFAULT_DEINTERLACE_SAMPLES; i++ {
+		scripts = append(scripts, IDET_INTERLACED)
+	}
+	for i := 0; i < DEFAULT_DEINTERLACE_SAMPLES; i++ {
+		scripts = append(scripts, IDET_TELECINED)
+	}
+	e.fake.Scans = scripts
+
+	e.verifyingProfile()
+	e.start()
+
+	e.enqueue("Broadcast")
+	e.enqueue("Film")
+	e.idle()
+
+	transcodes := e.fake.Transcodes()
+	if len(transcodes) != 2 {
+		t.Fatalf("Expected two ffmpeg runs, got %d", len(transcodes))
+	}
+	if vf := transcodes[0].Arg("-vf"); vf != "bwdif=mode=send_frame:parity=tff:deint=all" {
+		t.Errorf("Expected the broadcast to be deinterlaced, got %s", vf)
+	}
+	if vf := transcodes[1].Arg("-vf"); !strings.HasPrefix(vf, "fieldmatch=order=tff") || !strings.HasSuffix(vf, ",decimate") {
+		t.Errorf("Expected the film to be inverse telecined, got %s", vf)
+	}
+
+	for _, run := range e.fake.Runs {
+		if graph := run.Arg("-lavfi"); graph != "" && !strings.Contains(graph, "[1:v:0]bwdif=") && !strings.Contains(graph, "[1:v:0]fieldmatch=") {
+			t.Errorf("Expected the original to be deinterlaced before comparing %s", graph)
+		}
+	}
+
+	if meta := e.metadata("Broadcast/Broadcast"); meta.Scan != SCAN_INTERLACED || meta.Verification == nil {
+		t.Errorf("Expected the broadcast to be recorded as interlaced %+v", meta)
+	}
+	if meta := e.metadata("Film/Film"); meta.Scan != SCAN_TELECINED {
+		t.Errorf("Expected the film to be recorded as telecined %+v", meta)
+	}
+}
@@ -0,0 +1,273 @@
+//By TimTheSinner
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+/**
+ * Copyright (c) 2016 TimTheSinner All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Every file the fake ffmpeg writes starts with this, so the fake ffprobe can tell transcodes from originals
+const FAKE_TRANSCODE_MARKER = "fake transcode\n"
+
+const FAKE_QUALITY_GOOD = `[Parsed_ssim_4 @ 0x1] SSIM Y:0.991 (20.4) U:0.995 (23.1) V:0.995 (23.0) All:0.992512 (21.2)
+[Parsed_psnr_5 @ 0x2] PSNR y:44.10 u:48.90 v:49.20 average:45.480 min:40.10 max:inf`
+
+const FAKE_QUALITY_POOR = `[Parsed_ssim_4 @ 0x1] SSIM Y:0.801 (7.0) U:0.850 (8.2) V:0.850 (8.2) All:0.812300 (7.3)
+[Parsed_psnr_5 @ 0x2] PSNR y:24.10 u:28.90 v:29.20 average:25.480 min:20.10 max:31.00`
+
+const FAKE_SUBTITLE = "1\n00:00:01,000 --> 00:00:02,000\nHello\n"
+
+// A 4K movie with english and french audio, an english subtitle and a font attachment
+const FAKE_MOVIE_PROBE = `{
+	"format": {"filename": "movie", "format_name": "matroska,webm", "nb_streams": 5, "duration": "5400.000000", "bit_rate": "40000000"},
+	"streams": [
+		{"index": 0, "codec_name": "h264", "codec_type": "video", "width": 3840, "height": 2160, "pix_fmt": "yuv420p", "field_order": "progressive", "r_frame_rate": "24000/1001", "disposition": {"default": 1}},
+		{"index": 1, "codec_name": "ac3", "codec_type": "audio", "channels": 6, "channel_layout": "5.1(side)", "tags": {"language": "eng"}},
+		{"index": 2, "codec_name": "ac3", "codec_type": "audio", "channels": 6, "channel_layout": "5.1(side)", "tags": {"language": "fre"}},
+		{"index": 3, "codec_name": "subrip", "codec_type": "subtitle", "tags": {"language": "eng"}},
+		{"index": 4, "codec_name": "ttf", "codec_type": "attachment", "tags": {"filename": "font.ttf", "mimetype": "application/x-truetype-font"}}
+	]
+}`
+
+// What the default profile makes of FAKE_MOVIE_PROBE
+const FAKE_TRANSCODED_PROBE = `{
+	"format": {"filename": "movie", "format_name": "matroska,webm", "nb_streams": 4, "duration": "5400.020000", "bit_rate": "6000000"},
+	"streams": [
+		{"index": 0, "codec_name": "hevc", "codec_type": "video", "width": 1920, "height": 1080, "pix_fmt": "yuv420p", "r_frame_rate": "24000/1001", "disposition": {"default": 1}},
+		{"index": 1, "codec_name": "opus", "codec_type": "audio", "channels": 6, "channel_layout": "5.1", "tags": {"language": "eng"}},
+		{"index": 2, "codec_name": "subrip", "codec_type": "subtitle", "tags": {"language": "eng"}},
+		{"index": 3, "codec_name": "ttf", "codec_type": "attachment", "tags": {"filename": "font.ttf", "mimetype": "application/x-truetype-font"}}
+	]
+}`
+
+// FakeFFmpeg scripts a single transcoding ffmpeg run.
+type FakeFFmpeg struct {
+	// Progress is the out_time_us of each progress block written before ffmpeg exits
+	Progress []int64
+	// ExitStatus fails the run with a *CommandError when it is not zero
+	ExitStatus int
+	Stderr     string
+	// Block waits for the run to be cancelled
+	Block bool
+	// Started is closed once a blocking run is waiting
+	Started chan struct{}
+}
+
+type FakeRun struct {
+	Command string
+	Args    []string
+}
+
+// Arg returns the value following flag, or "" when the run did not use it.
+func (r FakeRun) Arg(flag string) string {
+	for i := 0; i < len(r.Args)-1; i++ {
+		if r.Args[i] == flag {
+			return r.Args[i+1]
+		}
+	}
+	return ""
+}
+
+// Has reports whether flag appears with value anywhere in the arguments.
+func (r FakeRun) Has(flag, value string) bool {
+	for i := 0; i < len(r.Args)-1; i++ {
+		if r.Args[i] == flag && r.Args[i+1] == value {
+			return true
+		}
+	}
+	return false
+}
+
+// FakeExecutor answers ffprobe with canned JSON and plays scripted ffmpeg runs, writing a small marker
+// file as the output so the rest of the pipeline sees a finished encode.
+type FakeExecutor struct {
+	lock sync.Mutex
+
+	// Probes is the ffprobe JSON of originals by file name, "" is the fallback for every other file
+	Probes map[string]string
+	// Transcoded is the ffprobe JSON of anything the fake ffmpeg wrote
+	Transcoded string
+	// FFmpeg is played in order for transcoding runs, the last entry repeats and none means success
+	FFmpeg []FakeFFmpeg
+	// Quality is the stderr of verification runs
+	Quality string
+	// Crops and Scans are the stderr of cropdetect and idet runs in order, the last entry repeats and none detects nothing
+	Crops []string
+	Scans []string
+
+	Runs []FakeRun
+}
+
+func NewFakeExecutor() *FakeExecutor {
+	return &FakeExecutor{
+		Probes:     map[string]string{"": FAKE_MOVIE_PROBE},
+		Transcoded: FAKE_TRANSCODED_PROBE,
+		Quality:    FAKE_QUALITY_GOOD,
+	}
+}
+
+func (f *FakeExecutor) record(command string, args []string) FakeRun {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	// Runs pinned to CPUs are recorded as the command taskset wraps
+	if command == "taskset" && len(args) >= 3 {
+		command, args = args[2], args[3:]
+	}
+
+	run := FakeRun{command, append([]string(nil), args...)}
+	f.Runs = append(f.Runs, run)
+	return run
+}
+
+// Transcodes are the ffmpeg runs that encoded a movie, leaving out analysis, verification and subtitle extraction.
+func (f *FakeExecutor) Transcodes() []FakeRun {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	runs := make([]FakeRun, 0)
+	for _, run := range f.Runs {
+		if run.Command == "ffmpeg" && run.Arg("-progress") != "" {
+			runs = append(runs, run)
+		}
+	}
+	return runs
+}
+
+func (f *FakeExecutor) nextFFmpeg() FakeFFmpeg {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if len(f.FFmpeg) == 0 {
+		return FakeFFmpeg{Progress: []int64{1800000000, 3600000000}}
+	}
+
+	script := f.FFmpeg[0]
+	if len(f.FFmpeg) > 1 {
+		f.FFmpeg = f.FFmpeg[1:]
+	}
+	return script
+}
+
+func (f *FakeExecutor) nextAnalysis(scripts *[]string) string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if len(*scripts) == 0 {
+		return ""
+	}
+
+	stderr := (*scripts)[0]
+	if len(*scripts) > 1 {
+		*scripts = (*scripts)[1:]
+	}
+	return stderr
+}
+
+func (f *FakeExecutor) Run(ctx context.Context, stdout io.Writer, command string, args ...string) (string, error) {
+	run := f.record(command, args)
+	if run.Command != "ffmpeg" {
+		return "", &CommandError{run.Command, -1, "", fmt.Errorf("fake executor cannot run %s", run.Command)}
+	}
+
+	if run.Arg("-lavfi") != "" {
+		f.lock.Lock()
+		defer f.lock.Unlock()
+		return f.Quality, nil
+	}
+
+	if detect := run.Arg("-vf"); strings.HasPrefix(detect, "cropdetect") {
+		return f.nextAnalysis(&f.Crops), nil
+	} else if detect == "idet" {
+		return f.nextAnalysis(&f.Scans), nil
+	}
+
+	if run.Arg("-progress") == "" {
+		// Extracting subtitles, every output follows its -f format
+		for i := 0; i < len(run.Args)-2; i++ {
+			if run.Args[i] == "-f" {
+				if err := ioutil.WriteFile(run.Args[i+2], []byte(FAKE_SUBTITLE), 0644); err != nil {
+					return "", &CommandError{run.Command, 1, err.Error(), err}
+				}
+			}
+		}
+		return "", nil
+	}
+
+	script := f.nextFFmpeg()
+	for _, outTime := range script.Progress {
+		fmt.Fprintf(stdout, "frame=%d\nfps=48.0\nbitrate=6000.0kbits/s\ntotal_size=%d\nout_time_us=%d\nspeed=2.0x\nprogress=continue\n",
+			outTime/41708, outTime/1000, outTime)
+	}
+
+	if script.Block {
+		if script.Started != nil {
+			close(script.Started)
+		}
+		<-ctx.Done()
+		return script.Stderr, ctx.Err()
+	}
+
+	if script.ExitStatus != 0 {
+		err := fmt.Errorf("exit status %d", script.ExitStatus)
+		return script.Stderr, &CommandError{run.Command, script.ExitStatus, script.Stderr, err}
+	}
+
+	output := run.Args[len(run.Args)-1]
+	if err := ioutil.WriteFile(output, []byte(FAKE_TRANSCODE_MARKER+strings.Join(run.Args, " ")), 0644); err != nil {
+		return "", &CommandError{run.Command, 1, err.Error(), err}
+	}
+	fmt.Fprint(stdout, "progress=end\n")
+	return script.Stderr, nil
+}
+
+func (f *FakeExecutor) Output(ctx context.Context, command string, args ...string) ([]byte, error) {
+	run := f.record(command, args)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	} else if run.Command != "ffprobe" || len(run.Args) == 0 {
+		return nil, &CommandError{run.Command, -1, "", fmt.Errorf("fake executor cannot run %s", run.Command)}
+	}
+
+	file := run.Args[len(run.Args)-1]
+	head := make([]byte, len(FAKE_TRANSCODE_MARKER))
+	in, err := os.Open(file)
+	if err != nil {
+		return nil, &CommandError{run.Command, 1, err.Error(), err}
+	}
+	defer in.Close()
+	io.ReadFull(in, head)
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if bytes.Equal(head, []byte(FAKE_TRANSCODE_MARKER)) {
+		return []byte(f.Transcoded), nil
+	} else if probe, ok := f.Probes[filepath.Base(file)]; ok {
+		return []byte(probe), nil
+	}
+	return []byte(f.Probes[""]), nil
+}
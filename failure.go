@@ -0,0 +1,181 @@
+//By TimTheSinner
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+/**
+ * Copyright (c) 2016 TimTheSinner All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+const (
+	REASON_LOCKED    = "locked"
+	REASON_PROBE     = "probe"
+	REASON_LANGUAGES = "languages"
+	REASON_PROFILE   = "profile"
+	REASON_FFMPEG    = "ffmpeg"
+	REASON_VERIFY    = "verify"
+	REASON_REPLACE   = "replace"
+)
+
+// TranscodeError explains why a movie could not be transcoded, Reason is one of the REASON_ constants.
+type TranscodeError struct {
+	Reason     string
+	ExitStatus int
+	Stderr     string
+	Err        error
+}
+
+func (e *TranscodeError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Reason, e.Err)
+}
+
+func (e *TranscodeError) Unwrap() error {
+	return e.Err
+}
+
+func failed(reason string, err error) *TranscodeError {
+	failure := &TranscodeError{Reason: reason, Err: err}
+	if command, ok := err.(*CommandError); ok {
+		failure.ExitStatus = command.ExitStatus
+		failure.Stderr = command.Stderr
+	}
+	return failure
+}
+
+// TranscodeFailure is the failure history recorded in transcode-metadata.json for a movie.
+type TranscodeFailure struct {
+	Reason       string    `json:"reason"`
+	Error        string    `json:"error"`
+	ExitStatus   int       `json:"exitStatus,omitempty"`
+	Stderr       string    `json:"stderr,omitempty"`
+	Attempts     int       `json:"attempts"`
+	FirstAttempt time.Time `json:"firstAttempt"`
+	LastAttempt  time.Time `json:"lastAttempt"`
+
+	// Size of the movie that failed, a different size means a new download and a fresh set of attempts
+	OriginalSize int64 `json:"originalSize"`
+}
+
+// recordFailure returns the failure history for another failed attempt at a movie of originalSize bytes.
+func recordFailure(previous *TranscodeFailure, err error, originalSize int64) *TranscodeFailure {
+	now := time.Now()
+	failure := &TranscodeFailure{
+		Reason:       "unknown",
+		Error:        err.Error(),
+		Attempts:     1,
+		FirstAttempt: now,
+		LastAttempt:  now,
+		OriginalSize: originalSize,
+	}
+
+	if transcodeErr, ok := err.(*TranscodeError); ok {
+		failure.Reason = transcodeErr.Reason
+		failure.ExitStatus = transcodeErr.ExitStatus
+		failure.Stderr = transcodeErr.Stderr
+	}
+
+	if previous != nil && previous.OriginalSize == originalSize {
+		failure.Attempts = previous.Attempts + 1
+		failure.FirstAttempt = previous.FirstAttempt
+	}
+	return failure
+}
+
+// Duration decodes JSON strings like "90m" or "24h".
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(raw []byte) error {
+	var value string
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return fmt.Errorf("Durations must be strings like \"90m\": %v", err)
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	d.Duration = duration
+	return nil
+}
+
+// The longest a retry is held back when the policy sets no maxBackoff
+const RETRY_BACKOFF_CEILING = 365 * 24 * time.Hour
+
+// RetryPolicy backs off exponentially between attempts and gives up after MaxAttempts, 0 retries forever.
+type RetryPolicy struct {
+	MaxAttempts int      `json:"maxAttempts"`
+	Backoff     Duration `json:"backoff"`
+	MaxBackoff  Duration `json:"maxBackoff"`
+}
+
+func flagRetryPolicy() *RetryPolicy {
+	return &RetryPolicy{
+		MaxAttempts: *maxAttempts,
+		Backoff:     Duration{*retryBackoff},
+		MaxBackoff:  Duration{24 * time.Hour},
+	}
+}
+
+// inherit fills what the config left out from the flags, a maxAttempts of 0 there takes -max-attempts.
+func (p *RetryPolicy) inherit(defaults *RetryPolicy) {
+	if p.MaxAttempts == 0 {
+		p.MaxAttempts = defaults.MaxAttempts
+	}
+	if p.Backoff.Duration == 0 {
+		p.Backoff = defaults.Backoff
+	}
+	if p.MaxBackoff.Duration == 0 {
+		p.MaxBackoff = defaults.MaxBackoff
+	}
+}
+
+func (p *RetryPolicy) Validate() error {
+	if p.MaxAttempts < 0 || p.Backoff.Duration < 0 || p.MaxBackoff.Duration < 0 {
+		return fmt.Errorf("Retry policy values must not be negative")
+	}
+	return nil
+}
+
+// NextAttempt is when the movie may be tried again, ok is false once the policy has given up on it.
+func (p *RetryPolicy) NextAttempt(failure *TranscodeFailure) (next time.Time, ok bool) {
+	if p.MaxAttempts > 0 && failure.Attempts >= p.MaxAttempts {
+		return time.Time{}, false
+	}
+
+	ceiling := p.MaxBackoff.Duration
+	if ceiling == 0 {
+		ceiling = RETRY_BACKOFF_CEILING
+	}
+
+	// Doubling stops at the ceiling, long before it could overflow
+	backoff := p.Backoff.Duration
+	for i := 1; i < failure.Attempts && backoff < ceiling; i++ {
+		backoff *= 2
+	}
+	if backoff > ceiling {
+		backoff = ceiling
+	}
+	return failure.LastAttempt.Add(backoff), true
+}
@@ -0,0 +1,42 @@
+//By TimTheSinner
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+/**
+ * Copyright (c) 2016 TimTheSinner All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+func TestRetryBackoffSaturates(t *testing.T) {
+	last := time.Now()
+	forever := &RetryPolicy{Backoff: Duration{time.Minute}}
+	for _, attempts := range []int{40, 1000} {
+		next, ok := forever.NextAttempt(&TranscodeFailure{Attempts: attempts, LastAttempt: last})
+		if !ok || next.Sub(last) != RETRY_BACKOFF_CEILING {
+			t.Errorf("Expected %d attempts to wait the ceiling, got %s", attempts, next.Sub(last))
+		}
+	}
+
+	capped := &RetryPolicy{Backoff: Duration{time.Minute}, MaxBackoff: Duration{time.Hour}}
+	if next, _ := capped.NextAttempt(&TranscodeFailure{Attempts: 3, LastAttempt: last}); next.Sub(last) != 4*time.Minute {
+		t.Errorf("Expected the backoff to double, got %s", next.Sub(last))
+	}
+	if next, _ := capped.NextAttempt(&TranscodeFailure{Attempts: 40, LastAttempt: last}); next.Sub(last) != time.Hour {
+		t.Errorf("Expected the maxBackoff, got %s", next.Sub(last))
+	}
+}
@@ -0,0 +1,226 @@
+//By TimTheSinner
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/**
+ * Copyright (c) 2016 TimTheSinner All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// FilterStage is a slot in the video filter chain, stages render in the order declared here.
+type FilterStage int
+
+const (
+	// Fields are matched or deinterlaced first, everything after works on whole frames
+	STAGE_DEINTERLACE FilterStage = iota
+	STAGE_CROP
+	STAGE_DENOISE
+	// HDR is tonemapped after scaling, so fewer pixels go through the expensive part
+	STAGE_SCALE
+	STAGE_TONEMAP
+	STAGE_FPS
+	STAGE_FORMAT
+
+	FILTER_STAGES
+)
+
+// hqdn3d strengths by name, spatial luma and chroma then temporal luma and chroma
+var DENOISE_FILTERS = map[string]string{
+	"light":  "hqdn3d=2:1.5:3:2.25",
+	"medium": "hqdn3d=4:3:6:4.5",
+	"strong": "hqdn3d=8:6:12:9",
+}
+
+// Scaler algorithms swscale takes as flags
+var SCALE_ALGORITHMS = map[string]bool{
+	"fast_bilinear": true,
+	"bilinear":      true,
+	"bicubic":       true,
+	"neighbor":      true,
+	"area":          true,
+	"gauss":         true,
+	"sinc":          true,
+	"lanczos":       true,
+	"spline":        true,
+}
+
+// FilterGraph composes the video filters of an encode. It follows the frame size and rate through
+// the stages set so far, so scaling and frame rate limits see the frames they will actually get.
+type FilterGraph struct {
+	stages        [FILTER_STAGES]string
+	width, height int
+	rate          float64
+}
+
+// NewFilterGraph starts an empty graph for the frames of stream.
+func NewFilterGraph(stream *Stream) *FilterGraph {
+	// An unreadable rate is left at 0 and never limited
+	rate, _ := parseRational(stream.FrameRate)
+	return &FilterGraph{width: stream.FrameWidth(), height: stream.Height, rate: rate}
+}
+
+// Set replaces the filters of stage, "" removes the stage.
+func (g *FilterGraph) Set(stage FilterStage, filter string) *FilterGraph {
+	g.stages[stage] = filter
+	return g
+}
+
+func (g *FilterGraph) Stage(stage FilterStage) string {
+	return g.stages[stage]
+}
+
+// Deinterlace makes interlaced and telecined frames progressive, decimating telecined film back to its film rate.
+func (g *FilterGraph) Deinterlace(policy *DeinterlacePolicy, scan, parity string) *FilterGraph {
+	filter := policy.filter(scan, parity)
+	if filter != "" && scan == SCAN_TELECINED {
+		g.rate = g.rate * 4 / 5
+	}
+	return g.Set(STAGE_DEINTERLACE, filter)
+}
+
+func (g *FilterGraph) Crop(crop *Crop) *FilterGraph {
+	if crop == nil {
+		return g.Set(STAGE_CROP, "")
+	}
+	g.width, g.height = crop.Width, crop.Height
+	return g.Set(STAGE_CROP, crop.Filter())
+}
+
+// Denoise applies one of the DENOISE_FILTERS strengths, "" leaves the grain alone.
+func (g *FilterGraph) Denoise(strength string) *FilterGraph {
+	return g.Set(STAGE_DENOISE, DENOISE_FILTERS[strength])
+}
+
+// Scale fits the frames within maxWidth by maxHeight keeping their aspect ratio, 0 leaves a dimension unbounded.
+// Frames that already fit are never scaled up.
+func (g *FilterGraph) Scale(maxWidth, maxHeight int, algorithm string) *FilterGraph {
+	widthRatio, heightRatio := 1.0, 1.0
+	if maxWidth > 0 && g.width > maxWidth {
+		widthRatio = float64(maxWidth) / float64(g.width)
+	}
+	if maxHeight > 0 && g.height > maxHeight {
+		heightRatio = float64(maxHeight) / float64(g.height)
+	}
+
+	if widthRatio == 1 && heightRatio == 1 {
+		return g.Set(STAGE_SCALE, "")
+	} else if widthRatio <= heightRatio {
+		return g.scale(maxWidth, -2, algorithm)
+	}
+	return g.scale(-2, maxHeight, algorithm)
+}
+
+// ScaleTo scales the frames to exactly width by height.
+func (g *FilterGraph) ScaleTo(width, height int, algorithm string) *FilterGraph {
+	return g.scale(width, height, algorithm)
+}
+
+func (g *FilterGraph) scale(width, height int, algorithm string) *FilterGraph {
+	filter := "scale=" + strconv.Itoa(width) + ":" + strconv.Itoa(height)
+	if algorithm != "" {
+		filter += ":flags=" + algorithm
+	}
+
+	// -2 keeps the aspect ratio rounded to an even size
+	if width == -2 {
+		width = g.width * height / g.height
+	} else if height == -2 {
+		height = g.height * width / g.width
+	}
+	g.width, g.height = width, height
+	return g.Set(STAGE_SCALE, filter)
+}
+
+// Tonemap takes a filter built by TonemapPolicy.filter, "" leaves the colors as they are.
+func (g *FilterGraph) Tonemap(filter string) *FilterGraph {
+	return g.Set(STAGE_TONEMAP, filter)
+}
+
+// FPS drops frames down to maxRate, like 30000/1001, when the frames come faster. "" keeps every frame.
+func (g *FilterGraph) FPS(maxRate string) *FilterGraph {
+	rate, err := parseRational(maxRate)
+	if maxRate == "" || err != nil || rate <= 0 || g.rate <= rate {
+		return g.Set(STAGE_FPS, "")
+	}
+	g.rate = rate
+	return g.Set(STAGE_FPS, "fps="+maxRate)
+}
+
+func (g *FilterGraph) Format(pixFmt string) *FilterGraph {
+	if pixFmt == "" {
+		return g.Set(STAGE_FORMAT, "")
+	}
+	return g.Set(STAGE_FORMAT, "format="+pixFmt)
+}
+
+// Reference carries the stages that decide which pixels and frames make it into the encode over to a new graph,
+// for the original to be compared against the encode like for like.
+func (g *FilterGraph) Reference() *FilterGraph {
+	reference := &FilterGraph{width: g.width, height: g.height, rate: g.rate}
+	for _, stage := range []FilterStage{STAGE_DEINTERLACE, STAGE_CROP, STAGE_TONEMAP, STAGE_FPS} {
+		reference.stages[stage] = g.stages[stage]
+	}
+	return reference
+}
+
+// Filters lists the set stages in chain order.
+func (g *FilterGraph) Filters() []string {
+	filters := make([]string, 0, FILTER_STAGES)
+	for _, filter := range g.stages {
+		if filter != "" {
+			filters = append(filters, filter)
+		}
+	}
+	return filters
+}
+
+// String renders the chain as -vf takes it, "" when no stage is set.
+func (g *FilterGraph) String() string {
+	return strings.Join(g.Filters(), ",")
+}
+
+// Args are the -vf arguments of the chain, none when there is nothing to filter.
+func (g *FilterGraph) Args() []string {
+	if chain := g.String(); chain != "" {
+		return []string{"-vf", chain}
+	}
+	return nil
+}
+
+// Complex renders the chain as a -filter_complex chain from the input pad to the output pad.
+func (g *FilterGraph) Complex(input, output string) string {
+	chain := g.String()
+	if chain == "" {
+		chain = "null"
+	}
+	return fmt.Sprintf("[%s]%s[%s]", input, chain, output)
+}
+
+// filterGraph composes the video filters for an encode of stream with the profile's limits.
+// Interlaced frames are made progressive first, everything after works on whole frames, and
+// black bars are cropped before scaling so the width limit applies to the picture itself.
+func (p *Profile) filterGraph(stream *Stream, scan, parity string, crop *Crop, tonemap string) *FilterGraph {
+	return NewFilterGraph(stream).
+		Deinterlace(p.Deinterlace, scan, parity).
+		Crop(crop).
+		Denoise(p.Denoise).
+		Scale(p.MaxWidth, p.MaxHeight, p.ScaleAlgorithm).
+		Tonemap(tonemap).
+		FPS(p.MaxFrameRate)
+}
@@ -0,0 +1,129 @@
+//By TimTheSinner
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+/**
+ * Copyright (c) 2016 TimTheSinner All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+func uhdStream() *Stream {
+	return &Stream{Width: 3840, Height: 2160, FrameRate: "30000/1001"}
+}
+
+func TestFilterGraphStageOrder(t *testing.T) {
+	graph := NewFilterGraph(uhdStream()).
+		Format("yuv420p").
+		FPS("24000/1001").
+		Scale(1920, 0, "").
+		Denoise("light").
+		Crop(&Crop{3840, 1600, 0, 280})
+
+	expected := []string{"crop=3840:1600:0:280", "hqdn3d=2:1.5:3:2.25", "scale=1920:-2", "fps=24000/1001", "format=yuv420p"}
+	if filters := graph.Filters(); !reflect.DeepEqual(filters, expected) {
+		t.Errorf("Expected %v, got %v", expected, filters)
+	}
+	if args := graph.Args(); !reflect.DeepEqual(args, []string{"-vf", "crop=3840:1600:0:280,hqdn3d=2:1.5:3:2.25,scale=1920:-2,fps=24000/1001,format=yuv420p"}) {
+		t.Errorf("Unexpected -vf %v", args)
+	}
+
+	if args := NewFilterGraph(uhdStream()).Args(); args != nil {
+		t.Errorf("Expected no -vf for an empty graph, got %v", args)
+	}
+}
+
+func TestFilterGraphScale(t *testing.T) {
+	tests := []struct {
+		maxWidth, maxHeight int
+		algorithm           string
+		crop                *Crop
+		expected            string
+	}{
+		{1920, 0, "", nil, "scale=1920:-2"},
+		{0, 720, "lanczos", nil, "scale=-2:720:flags=lanczos"},
+		// A scope picture is bound by the width, 1920x800 already fits 1080 lines
+		{1920, 1080, "", &Crop{3840, 1600, 0, 280}, "scale=1920:-2"},
+		// A 4:3 picture is bound by the height
+		{1920, 1080, "", &Crop{2880, 2160, 480, 0}, "scale=-2:1080"},
+		{3840, 0, "", nil, ""},
+		{0, 0, "", nil, ""},
+	}
+
+	for _, test := range tests {
+		graph := NewFilterGraph(uhdStream()).Crop(test.crop).Scale(test.maxWidth, test.maxHeight, test.algorithm)
+		if scale := graph.Stage(STAGE_SCALE); scale != test.expected {
+			t.Errorf("Expected %dx%d to scale with %q, got %q", test.maxWidth, test.maxHeight, test.expected, scale)
+		}
+	}
+}
+
+func TestFilterGraphFrameRate(t *testing.T) {
+	deinterlace := &DeinterlacePolicy{Mode: DEINTERLACE_AUTO, Filter: DEFAULT_DEINTERLACE_FILTER}
+
+	// Decimated film already runs at 23.976, under the limit
+	graph := NewFilterGraph(uhdStream()).Deinterlace(deinterlace, SCAN_TELECINED, "tff").FPS("25")
+	if fps := graph.Stage(STAGE_FPS); fps != "" {
+		t.Errorf("Expected decimated film to keep its rate, got %s", fps)
+	}
+
+	graph = NewFilterGraph(uhdStream()).Deinterlace(deinterlace, SCAN_INTERLACED, "tff").FPS("25")
+	if fps := graph.Stage(STAGE_FPS); fps != "fps=25" {
+		t.Errorf("Expected 29.97 to drop to 25, got %q", fps)
+	}
+
+	if fps := NewFilterGraph(&Stream{Width: 1920, Height: 1080, FrameRate: "0/0"}).FPS("25").Stage(STAGE_FPS); fps != "" {
+		t.Errorf("Expected an unknown rate to be left alone, got %s", fps)
+	}
+}
+
+func TestFilterGraphComplex(t *testing.T) {
+	graph := NewFilterGraph(uhdStream()).
+		Deinterlace(&DeinterlacePolicy{Mode: DEINTERLACE_AUTO, Filter: "yadif"}, SCAN_INTERLACED, "bff").
+		Crop(&Crop{3840, 1600, 0, 280}).
+		Denoise("strong").
+		Scale(1920, 0, "")
+
+	reference := graph.Reference().ScaleTo(1920, 800, "bicubic").Format("yuv420p")
+	expected := "[1:v:0]yadif=mode=send_frame:parity=bff:deint=all,crop=3840:1600:0:280,scale=1920:800:flags=bicubic,format=yuv420p[ref]"
+	if complex := reference.Complex("1:v:0", "ref"); complex != expected {
+		t.Errorf("Expected the reference to skip denoising %s, got %s", expected, complex)
+	}
+
+	if complex := NewFilterGraph(uhdStream()).Complex("0:v:0", "v"); complex != "[0:v:0]null[v]" {
+		t.Errorf("Expected an empty chain to pass frames through, got %s", complex)
+	}
+}
+
+func TestProfileFilterGraph(t *testing.T) {
+	profile := &Profile{Name: "pi", MaxWidth: 1280, ScaleAlgorithm: "spline", MaxFrameRate: "30", Denoise: "wet"}
+	profile.inherit(flagProfile())
+	if err := profile.Validate(); err == nil {
+		t.Error("Expected an unknown denoise strength to be rejected")
+	}
+
+	profile.Denoise = "medium"
+	if err := profile.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	stream := &Stream{Width: 1920, Height: 1080, FrameRate: "60000/1001", FieldOrder: "tt"}
+	expected := "bwdif=mode=send_frame:parity=tff:deint=all,hqdn3d=4:3:6:4.5,scale=1280:-2:flags=spline,fps=30"
+	if graph := profile.filterGraph(stream, SCAN_INTERLACED, "tff", nil, ""); graph.String() != expected {
+		t.Errorf("Expected %s, got %s", expected, graph)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/nightlyone/lockfile"
@@ -37,6 +38,13 @@ type Lockfile struct {
 var (
 	ErrPidMissmatch   = errors.New("Lockfile has a different pid")
 	ErrMissingPidFile = errors.New("Could not find pid file")
+	ErrLockHeld       = errors.New("Lockfile is held by another worker")
+)
+
+// The pid in a lockfile only tells processes apart, workers of this process claim a lockfile here first.
+var (
+	heldLock  sync.Mutex
+	heldLocks = make(map[string]bool)
 )
 
 func NewLockfile(path string) (Lockfile, error) {
@@ -45,14 +53,34 @@ func NewLockfile(path string) (Lockfile, error) {
 		return Lockfile{"", lock}, err
 	}
 
+	heldLock.Lock()
+	defer heldLock.Unlock()
+	if heldLocks[string(lock)] {
+		return Lockfile{"", lockfile.Lockfile("")}, ErrLockHeld
+	}
+
 	ourLock := Lockfile{path, lock}
 	err = ourLock.TryLock()
 	if err != nil {
 		return Lockfile{"", lockfile.Lockfile("")}, err
 	}
+	heldLocks[string(lock)] = true
 	return ourLock, nil
 }
 
+// Unlock removes the lockfile and lets the other workers of this process claim it again.
+func (l Lockfile) Unlock() error {
+	heldLock.Lock()
+	defer heldLock.Unlock()
+
+	if !heldLocks[string(l.Lockfile)] {
+		// Never claimed by this holder, the file belongs to someone else
+		return lockfile.ErrRogueDeletion
+	}
+	delete(heldLocks, string(l.Lockfile))
+	return l.Lockfile.Unlock()
+}
+
 func (l Lockfile) TryLock() error {
 	name := l.name
 
@@ -70,7 +98,13 @@ func (l Lockfile) TryLock() error {
 	//If the lockfile exists
 	if _, err = os.Stat(name); err == nil {
 		_ = os.Remove(tmplock.Name())
-		if proc, err := l.GetOwner(); err != nil {
+		if proc, err := l.GetOwner(); err == lockfile.ErrDeadOwner || err == lockfile.ErrInvalidPid {
+			// A previous run died while holding the lock, clear it and try again
+			if err = os.Remove(name); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			return l.TryLock()
+		} else if err != nil {
 			return err
 		} else if proc.Pid != os.Getpid() {
 			return ErrPidMissmatch
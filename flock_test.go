@@ -0,0 +1,58 @@
+//By TimTheSinner
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+/**
+ * Copyright (c) 2016 TimTheSinner All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+func TestLockfileExcludesWorkers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transcoder-lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "transcoding.lck")
+	held, err := NewLockfile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Another worker of the same process must not share the lock or release it
+	if other, err := NewLockfile(path); err != ErrLockHeld {
+		t.Fatalf("Expected the second worker to be refused, got %v", err)
+	} else if err := other.Unlock(); err == nil {
+		t.Error("A refused worker should not be able to unlock")
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("The holder lost its lockfile: %v", err)
+	}
+
+	if err := held.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	again, err := NewLockfile(path)
+	if err != nil {
+		t.Fatalf("Expected the lock to be free again: %v", err)
+	}
+	again.Unlock()
+}
@@ -3,6 +3,7 @@ module github.com/timthesinner/go-media-transcoder
 require (
 	github.com/fsnotify/fsnotify v1.4.9
 	github.com/nightlyone/lockfile v0.0.0-20180618180623-0ad87eef1443
+	go.etcd.io/bbolt v1.3.5
 )
 
 go 1.14
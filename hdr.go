@@ -0,0 +1,314 @@
+//By TimTheSinner
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+/**
+ * Copyright (c) 2016 TimTheSinner All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+const (
+	// Keep HDR sources HDR when the video codec can carry it
+	HDR_PRESERVE = "preserve"
+	// Encode everything as SDR
+	HDR_SDR = "sdr"
+)
+
+const (
+	HDR10 = "hdr10"
+	HLG   = "hlg"
+)
+
+const (
+	// Skip tonemapping, HDR encoded as SDR keeps the washed out look of the raw signal
+	TONEMAP_OFF = "off"
+	// Reference white in cd/m2 that HDR is linearized against before tonemapping
+	TONEMAP_NOMINAL_PEAK = 100
+)
+
+// Curves the tonemap filter implements
+var TONEMAP_ALGORITHMS = map[string]bool{
+	"none":     true,
+	"clip":     true,
+	"linear":   true,
+	"gamma":    true,
+	"reinhard": true,
+	"hable":    true,
+	"mobius":   true,
+}
+
+const (
+	MASTERING_DISPLAY_SIDE_DATA = "Mastering display metadata"
+	CONTENT_LIGHT_SIDE_DATA     = "Content light level metadata"
+)
+
+// Encoders that can carry HDR and the 10-bit pixel format each takes
+var HDR_ENCODERS = map[string]string{
+	"libx265":    "yuv420p10le",
+	"libsvtav1":  "yuv420p10le",
+	"libaom-av1": "yuv420p10le",
+	"hevc_nvenc": "p010le",
+	"hevc_amf":   "p010le",
+	"hevc_qsv":   "p010le",
+	"av1_nvenc":  "p010le",
+	"av1_amf":    "p010le",
+	"av1_qsv":    "p010le",
+}
+
+// HDRMetadata is what an HDR source signals, carried over so players switch into the right mode.
+type HDRMetadata struct {
+	Format    string
+	Primaries string
+	Transfer  string
+	Matrix    string
+	Range     string
+
+	// Mastering display primaries and white point in CIE 1931 xy, luminance in cd/m2
+	Green, Blue, Red, WhitePoint [2]float64
+	MaxLuminance, MinLuminance   float64
+	HasMasteringDisplay          bool
+
+	MaxCLL, MaxFALL int
+}
+
+// HDRFormat classifies a video stream by its transfer characteristics, SDR is "".
+func (s *Stream) HDRFormat() string {
+	switch s.ColorTransfer {
+	case "smpte2084":
+		return HDR10
+	case "arib-std-b67":
+		return HLG
+	default:
+		return ""
+	}
+}
+
+// parseRational reads the "34000/50000" fractions ffprobe reports side data in.
+func parseRational(value string) (float64, error) {
+	parts := strings.SplitN(value, "/", 2)
+	numerator, err := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	if err != nil || len(parts) == 1 {
+		return numerator, err
+	}
+
+	denominator, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	if err != nil {
+		return 0, err
+	} else if denominator == 0 {
+		return 0, fmt.Errorf("Rational %q has a zero denominator", value)
+	}
+	return numerator / denominator, nil
+}
+
+// hdrMetadata describes an HDR video stream, SDR streams return nil.
+func hdrMetadata(stream *Stream) *HDRMetadata {
+	format := stream.HDRFormat()
+	if format == "" {
+		return nil
+	}
+
+	hdr := &HDRMetadata{
+		Format:    format,
+		Primaries: stream.ColorPrimaries,
+		Transfer:  stream.ColorTransfer,
+		Matrix:    stream.ColorSpace,
+		Range:     stream.ColorRange,
+	}
+
+	// HDR without signalled primaries or matrix is invariably BT.2020
+	if hdr.Primaries == "" || hdr.Primaries == "unknown" {
+		hdr.Primaries = "bt2020"
+	}
+	if hdr.Matrix == "" || hdr.Matrix == "unknown" {
+		hdr.Matrix = "bt2020nc"
+	}
+
+	if display := stream.SideDataOfType(MASTERING_DISPLAY_SIDE_DATA); display != nil {
+		values := []string{display.GreenX, display.GreenY, display.BlueX, display.BlueY, display.RedX, display.RedY,
+			display.WhitePointX, display.WhitePointY, display.MaxLuminance, display.MinLuminance}
+		parsed := make([]float64, len(values))
+
+		hdr.HasMasteringDisplay = true
+		for i, value := range values {
+			var err error
+			if parsed[i], err = parseRational(value); err != nil {
+				hdr.HasMasteringDisplay = false
+				break
+			}
+		}
+
+		if hdr.HasMasteringDisplay {
+			hdr.Green = [2]float64{parsed[0], parsed[1]}
+			hdr.Blue = [2]float64{parsed[2], parsed[3]}
+			hdr.Red = [2]float64{parsed[4], parsed[5]}
+			hdr.WhitePoint = [2]float64{parsed[6], parsed[7]}
+			hdr.MaxLuminance, hdr.MinLuminance = parsed[8], parsed[9]
+		}
+	}
+
+	if light := stream.SideDataOfType(CONTENT_LIGHT_SIDE_DATA); light != nil {
+		hdr.MaxCLL, hdr.MaxFALL = light.MaxContent, light.MaxAverage
+	}
+	return hdr
+}
+
+// x265MasterDisplay renders the mastering display in x265 units, 0.00002 for chromaticity and 0.0001 cd/m2 for luminance.
+func (h *HDRMetadata) x265MasterDisplay() string {
+	chroma := func(xy [2]float64) string {
+		return fmt.Sprintf("(%d,%d)", int64(math.Round(xy[0]*50000)), int64(math.Round(xy[1]*50000)))
+	}
+	return fmt.Sprintf("G%sB%sR%sWP%sL(%d,%d)", chroma(h.Green), chroma(h.Blue), chroma(h.Red), chroma(h.WhitePoint),
+		int64(math.Round(h.MaxLuminance*10000)), int64(math.Round(h.MinLuminance*10000)))
+}
+
+// svtMasteringDisplay renders the mastering display the way SVT-AV1 takes it, as plain decimals.
+func (h *HDRMetadata) svtMasteringDisplay() string {
+	chroma := func(xy [2]float64) string {
+		return fmt.Sprintf("(%.4f,%.4f)", xy[0], xy[1])
+	}
+	return fmt.Sprintf("G%sB%sR%sWP%sL(%.4f,%.4f)", chroma(h.Green), chroma(h.Blue), chroma(h.Red), chroma(h.WhitePoint), h.MaxLuminance, h.MinLuminance)
+}
+
+// encoderArgs signals the color properties on the output, embedding the static metadata for encoders that accept it.
+func (h *HDRMetadata) encoderArgs(codec string) []string {
+	args := []string{"-color_primaries", h.Primaries, "-color_trc", h.Transfer, "-colorspace", h.Matrix}
+	if h.Range != "" && h.Range != "unknown" {
+		args = append(args, "-color_range", h.Range)
+	}
+
+	switch codec {
+	case "libx265":
+		params := []string{"repeat-headers=1", "colorprim=" + h.Primaries, "transfer=" + h.Transfer, "colormatrix=" + h.Matrix}
+		if h.Format == HDR10 {
+			params = append(params, "hdr10=1", "hdr10-opt=1")
+			if h.HasMasteringDisplay {
+				params = append(params, "master-display="+h.x265MasterDisplay())
+			}
+			if h.MaxCLL > 0 {
+				params = append(params, fmt.Sprintf("max-cll=%d,%d", h.MaxCLL, h.MaxFALL))
+			}
+		}
+		args = append(args, "-x265-params", strings.Join(params, ":"))
+
+	case "libsvtav1":
+		params := make([]string, 0, 2)
+		if h.HasMasteringDisplay {
+			params = append(params, "mastering-display="+h.svtMasteringDisplay())
+		}
+		if h.MaxCLL > 0 {
+			params = append(params, fmt.Sprintf("content-light=%d,%d", h.MaxCLL, h.MaxFALL))
+		}
+		if len(params) > 0 {
+			args = append(args, "-svtav1-params", strings.Join(params, ":"))
+		}
+	}
+	return args
+}
+
+// TonemapPolicy maps HDR sources into SDR for profiles that encode SDR.
+type TonemapPolicy struct {
+	// Algorithm is a tonemap filter curve, or off to encode the HDR signal as is
+	Algorithm string `json:"algorithm,omitempty"`
+	// Peak overrides the source peak as a multiple of 100 cd/m2, 0 reads it from the stream
+	Peak  float64 `json:"peak,omitempty"`
+	Desat float64 `json:"desat,omitempty"`
+}
+
+func flagTonemapPolicy() *TonemapPolicy {
+	return &TonemapPolicy{Algorithm: *tonemapAlgorithm, Peak: *tonemapPeak}
+}
+
+func (p *TonemapPolicy) inherit(defaults *TonemapPolicy) {
+	if p.Algorithm == "" {
+		p.Algorithm = defaults.Algorithm
+	}
+	if p.Peak == 0 {
+		p.Peak = defaults.Peak
+	}
+	if p.Desat == 0 {
+		p.Desat = defaults.Desat
+	}
+}
+
+func (p *TonemapPolicy) Validate() error {
+	if p.Algorithm != TONEMAP_OFF && !TONEMAP_ALGORITHMS[p.Algorithm] {
+		return fmt.Errorf("Unknown tonemap algorithm %q", p.Algorithm)
+	} else if p.Peak < 0 || p.Desat < 0 {
+		return fmt.Errorf("Tonemap peak and desat must not be negative")
+	}
+	return nil
+}
+
+// filter linearizes the source, tonemaps it in BT.709 and converts it to pixFmt, "" when tonemapping is off.
+// zscale is told the source properties as many HDR rips do not tag their frames.
+func (p *TonemapPolicy) filter(source *HDRMetadata, pixFmt string) string {
+	if p == nil || p.Algorithm == TONEMAP_OFF {
+		return ""
+	}
+
+	rangeIn := source.Range
+	if rangeIn == "" || rangeIn == "unknown" {
+		rangeIn = "tv"
+	}
+
+	tonemap := "tonemap=tonemap=" + p.Algorithm + ":desat=" + strconv.FormatFloat(p.Desat, 'f', -1, 64)
+	if p.Peak > 0 {
+		tonemap += ":peak=" + strconv.FormatFloat(p.Peak, 'f', -1, 64)
+	}
+
+	return strings.Join([]string{
+		fmt.Sprintf("zscale=tin=%s:min=%s:pin=%s:rin=%s:t=linear:npl=%d", source.Transfer, source.Matrix, source.Primaries, rangeIn, TONEMAP_NOMINAL_PEAK),
+		"format=gbrpf32le",
+		"zscale=p=bt709",
+		tonemap,
+		"zscale=t=bt709:m=bt709:r=tv",
+		"format=" + pixFmt,
+	}, ",")
+}
+
+// Tags a tonemapped encode as the BT.709 it now is
+var SDR_COLOR_ARGS = []string{"-color_primaries", "bt709", "-color_trc", "bt709", "-colorspace", "bt709", "-color_range", "tv"}
+
+func isTenBit(pixFmt string) bool {
+	return strings.Contains(pixFmt, "10") || strings.Contains(pixFmt, "12")
+}
+
+// hdrEncoding decides how the profile encodes an HDR source, returning nil when the output will be SDR.
+func (p *Profile) hdrEncoding(hdr *HDRMetadata) (preserved *HDRMetadata, pixFmt string) {
+	if hdr == nil || p.HDR != HDR_PRESERVE {
+		return nil, p.PixFmt
+	}
+
+	tenBit, ok := HDR_ENCODERS[p.VideoCodec]
+	if !ok {
+		fmt.Printf("Profile %s encodes with %s which cannot carry %s, encoding SDR\n", p.Name, p.VideoCodec, hdr.Format)
+		return nil, p.PixFmt
+	}
+
+	if p.PixFmt == "" {
+		return hdr, tenBit
+	} else if isTenBit(p.PixFmt) {
+		return hdr, p.PixFmt
+	}
+
+	// An 8-bit pixel format is a deliberate SDR target, like a Pi that cannot decode anything deeper
+	fmt.Printf("Profile %s encodes %s which cannot carry %s, encoding SDR\n", p.Name, p.PixFmt, hdr.Format)
+	return nil, p.PixFmt
+}
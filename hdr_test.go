@@ -0,0 +1,139 @@
+//By TimTheSinner
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+/**
+ * Copyright (c) 2016 TimTheSinner All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// A P3 mastered 1000 nit HDR10 stream as ffprobe -show_streams reports it
+const HDR10_STREAM = `{
+	"index": 0, "codec_name": "hevc", "codec_type": "video", "width": 3840, "height": 2160, "pix_fmt": "yuv420p10le",
+	"color_range": "tv", "color_space": "bt2020nc", "color_transfer": "smpte2084", "color_primaries": "bt2020",
+	"side_data_list": [
+		{"side_data_type": "Mastering display metadata",
+			"red_x": "34000/50000", "red_y": "16000/50000", "green_x": "13250/50000", "green_y": "34500/50000",
+			"blue_x": "7500/50000", "blue_y": "3000/50000", "white_point_x": "15635/50000", "white_point_y": "16450/50000",
+			"min_luminance": "50/10000", "max_luminance": "10000000/10000"},
+		{"side_data_type": "Content light level metadata", "max_content": 1000, "max_average": 400}
+	]
+}`
+
+func hdrStream(t *testing.T, raw string) *Stream {
+	var stream Stream
+	if err := json.Unmarshal([]byte(raw), &stream); err != nil {
+		t.Fatal(err)
+	}
+	return &stream
+}
+
+func TestHDR10Preserved(t *testing.T) {
+	hdr := hdrMetadata(hdrStream(t, HDR10_STREAM))
+	if hdr == nil || hdr.Format != HDR10 || !hdr.HasMasteringDisplay {
+		t.Fatalf("Expected HDR10 with a mastering display %+v", hdr)
+	}
+
+	color := []string{"-color_primaries", "bt2020", "-color_trc", "smpte2084", "-colorspace", "bt2020nc", "-color_range", "tv"}
+	expected := append(color, "-x265-params",
+		"repeat-headers=1:colorprim=bt2020:transfer=smpte2084:colormatrix=bt2020nc:hdr10=1:hdr10-opt=1:"+
+			"master-display=G(13250,34500)B(7500,3000)R(34000,16000)WP(15635,16450)L(10000000,50):max-cll=1000,400")
+	if args := hdr.encoderArgs("libx265"); !reflect.DeepEqual(args, expected) {
+		t.Errorf("Expected %v, got %v", expected, args)
+	}
+
+	expected = append(color[:len(color):len(color)], "-svtav1-params",
+		"mastering-display=G(0.2650,0.6900)B(0.1500,0.0600)R(0.6800,0.3200)WP(0.3127,0.3290)L(1000.0000,0.0050):content-light=1000,400")
+	if args := hdr.encoderArgs("libsvtav1"); !reflect.DeepEqual(args, expected) {
+		t.Errorf("Expected %v, got %v", expected, args)
+	}
+
+	// Hardware encoders only get the color flags
+	if args := hdr.encoderArgs("hevc_amf"); !reflect.DeepEqual(args, color) {
+		t.Errorf("Expected %v, got %v", color, args)
+	}
+}
+
+func TestHLGPreserved(t *testing.T) {
+	hdr := hdrMetadata(hdrStream(t, `{"codec_type": "video", "color_transfer": "arib-std-b67"}`))
+	if hdr == nil || hdr.Format != HLG || hdr.HasMasteringDisplay {
+		t.Fatalf("Expected HLG without static metadata %+v", hdr)
+	}
+
+	// Unsignalled primaries and matrix are assumed to be BT.2020
+	expected := []string{"-color_primaries", "bt2020", "-color_trc", "arib-std-b67", "-colorspace", "bt2020nc",
+		"-x265-params", "repeat-headers=1:colorprim=bt2020:transfer=arib-std-b67:colormatrix=bt2020nc"}
+	if args := hdr.encoderArgs("libx265"); !reflect.DeepEqual(args, expected) {
+		t.Errorf("Expected %v, got %v", expected, args)
+	}
+}
+
+func TestHDREncoding(t *testing.T) {
+	hdr := hdrMetadata(hdrStream(t, HDR10_STREAM))
+	if sdr := hdrMetadata(&Stream{CodecType: "video", ColorTransfer: "bt709"}); sdr != nil {
+		t.Errorf("Expected bt709 to be SDR %+v", sdr)
+	}
+
+	tests := []struct {
+		codec, pixFmt, mode string
+		preserved           bool
+		expectedPixFmt      string
+	}{
+		{"libx265", "", HDR_PRESERVE, true, "yuv420p10le"},
+		{"libx265", "yuv420p12le", HDR_PRESERVE, true, "yuv420p12le"},
+		{"hevc_amf", "", HDR_PRESERVE, true, "p010le"},
+		{"hevc_amf", "p010le", HDR_PRESERVE, true, "p010le"},
+		// An 8-bit target stays SDR even when the codec could carry HDR
+		{"libx265", "yuv420p", HDR_PRESERVE, false, "yuv420p"},
+		{"hevc_amf", "yuv420p", HDR_PRESERVE, false, "yuv420p"},
+		{"libx264", "yuv420p", HDR_PRESERVE, false, "yuv420p"},
+		{"libx265", "yuv420p", HDR_SDR, false, "yuv420p"},
+	}
+
+	for _, test := range tests {
+		profile := &Profile{VideoCodec: test.codec, PixFmt: test.pixFmt, HDR: test.mode}
+		preserved, pixFmt := profile.hdrEncoding(hdr)
+		if (preserved != nil) != test.preserved || pixFmt != test.expectedPixFmt {
+			t.Errorf("%s %s %s: expected preserved=%t %s, got %+v %s", test.codec, test.pixFmt, test.mode, test.preserved, test.expectedPixFmt, preserved, pixFmt)
+		}
+	}
+}
+
+func TestTonemapFilter(t *testing.T) {
+	hdr := hdrMetadata(hdrStream(t, HDR10_STREAM))
+
+	expected := "zscale=tin=smpte2084:min=bt2020nc:pin=bt2020:rin=tv:t=linear:npl=100,format=gbrpf32le,zscale=p=bt709," +
+		"tonemap=tonemap=hable:desat=0,zscale=t=bt709:m=bt709:r=tv,format=yuv420p"
+	if filter := (&TonemapPolicy{Algorithm: "hable"}).filter(hdr, "yuv420p"); filter != expected {
+		t.Errorf("Expected %s, got %s", expected, filter)
+	}
+
+	expected = "zscale=tin=smpte2084:min=bt2020nc:pin=bt2020:rin=tv:t=linear:npl=100,format=gbrpf32le,zscale=p=bt709," +
+		"tonemap=tonemap=mobius:desat=0.5:peak=10,zscale=t=bt709:m=bt709:r=tv,format=yuv420p10le"
+	if filter := (&TonemapPolicy{Algorithm: "mobius", Peak: 10, Desat: 0.5}).filter(hdr, "yuv420p10le"); filter != expected {
+		t.Errorf("Expected %s, got %s", expected, filter)
+	}
+
+	if filter := (&TonemapPolicy{Algorithm: TONEMAP_OFF}).filter(hdr, "yuv420p"); filter != "" {
+		t.Errorf("Expected no filter when tonemapping is off, got %s", filter)
+	}
+	if err := (&TonemapPolicy{Algorithm: "filmic"}).Validate(); err == nil {
+		t.Errorf("Expected an unknown algorithm to be refused")
+	}
+}
@@ -0,0 +1,255 @@
+//By TimTheSinner
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+/**
+ * Copyright (c) 2016 TimTheSinner All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+const (
+	// Analyze sources the probe does not report as progressive and fix interlaced or telecined ones
+	DEINTERLACE_AUTO = "auto"
+	// Encode every frame as the decoder returns it
+	DEINTERLACE_OFF = "off"
+)
+
+const (
+	SCAN_PROGRESSIVE = "progressive"
+	SCAN_INTERLACED  = "interlaced"
+	// Film with 3:2 pulldown, every five frames hold four film frames spread over their fields
+	SCAN_TELECINED = "telecined"
+)
+
+const (
+	DEFAULT_DEINTERLACE_FILTER    = "bwdif"
+	DEFAULT_DEINTERLACE_SAMPLES   = 4
+	DEFAULT_DEINTERLACE_LENGTH    = 10 * time.Second
+	DEFAULT_DEINTERLACE_THRESHOLD = 0.1
+	// Pulldown combs two frames in five, a source combed far beyond that is interlaced through and through
+	TELECINE_MAX_INTERLACED = 0.75
+	// Pulldown repeats a field in two frames of five, idet spots fewer than that but never close to none
+	TELECINE_MIN_REPEATED = 0.1
+)
+
+// Deinterlacers that take the yadif mode, parity and deint options
+var DEINTERLACE_FILTERS = map[string]bool{"bwdif": true, "yadif": true}
+
+// The multi frame summary, steadier than the single frame one as it looks at the neighbouring frames too
+var idetMulti = regexp.MustCompile(`Multi frame detection: TFF:\s*(\d+)\s+BFF:\s*(\d+)\s+Progressive:\s*(\d+)\s+Undetermined:\s*(\d+)`)
+
+var idetRepeated = regexp.MustCompile(`Repeated Fields: Neither:\s*(\d+)\s+Top:\s*(\d+)\s+Bottom:\s*(\d+)`)
+
+// DeinterlacePolicy decides how interlaced and telecined sources are turned into progressive frames.
+type DeinterlacePolicy struct {
+	Mode   string `json:"mode,omitempty"`
+	Filter string `json:"filter,omitempty"`
+	// Samples of Length are run through idet, spread over the movie like verification samples
+	Samples int      `json:"samples,omitempty"`
+	Length  Duration `json:"length,omitempty"`
+	// Threshold is the share of frames idet has to find combed before a source counts as interlaced
+	Threshold float64 `json:"threshold,omitempty"`
+}
+
+func flagDeinterlacePolicy() *DeinterlacePolicy {
+	return &DeinterlacePolicy{Mode: *deinterlaceMode, Filter: DEFAULT_DEINTERLACE_FILTER}
+}
+
+func (p *DeinterlacePolicy) inherit(defaults *DeinterlacePolicy) {
+	if p.Mode == "" {
+		p.Mode = defaults.Mode
+	}
+	if p.Filter == "" {
+		p.Filter = defaults.Filter
+	}
+	if p.Samples == 0 {
+		p.Samples = defaults.Samples
+	}
+	if p.Length.Duration == 0 {
+		p.Length = defaults.Length
+	}
+	if p.Threshold == 0 {
+		p.Threshold = defaults.Threshold
+	}
+}
+
+func (p *DeinterlacePolicy) applyDefaults() {
+	if p.Samples == 0 {
+		p.Samples = DEFAULT_DEINTERLACE_SAMPLES
+	}
+	if p.Length.Duration == 0 {
+		p.Length.Duration = DEFAULT_DEINTERLACE_LENGTH
+	}
+	if p.Threshold == 0 {
+		p.Threshold = DEFAULT_DEINTERLACE_THRESHOLD
+	}
+}
+
+func (p *DeinterlacePolicy) Validate() error {
+	if p.Mode != DEINTERLACE_AUTO && p.Mode != DEINTERLACE_OFF {
+		return fmt.Errorf("Unknown deinterlace mode %q, expected %s or %s", p.Mode, DEINTERLACE_AUTO, DEINTERLACE_OFF)
+	} else if !DEINTERLACE_FILTERS[p.Filter] {
+		return fmt.Errorf("Unknown deinterlace filter %q, expected bwdif or yadif", p.Filter)
+	} else if p.Samples < 0 || p.Length.Duration < 0 {
+		return fmt.Errorf("Deinterlace samples and length must not be negative")
+	} else if p.Threshold < 0 || p.Threshold > 1 {
+		return fmt.Errorf("Deinterlace threshold must be between 0 and 1")
+	}
+	return nil
+}
+
+// ScanAnalysis adds up what idet decided about the sampled frames.
+type ScanAnalysis struct {
+	TFF, BFF, Progressive, Undetermined int
+	// Frames repeating a field of the one before, and frames that repeat neither
+	RepeatedTop, RepeatedBottom, RepeatedNeither int
+}
+
+// parseIdet reads the summary idet prints when it is torn down, false when there is none.
+func parseIdet(stderr string) (ScanAnalysis, bool) {
+	multi := idetMulti.FindAllStringSubmatch(stderr, -1)
+	if len(multi) == 0 {
+		return ScanAnalysis{}, false
+	}
+
+	last := multi[len(multi)-1]
+	analysis := ScanAnalysis{TFF: atoi(last[1]), BFF: atoi(last[2]), Progressive: atoi(last[3]), Undetermined: atoi(last[4])}
+	if repeated := idetRepeated.FindAllStringSubmatch(stderr, -1); len(repeated) > 0 {
+		last = repeated[len(repeated)-1]
+		analysis.RepeatedNeither, analysis.RepeatedTop, analysis.RepeatedBottom = atoi(last[1]), atoi(last[2]), atoi(last[3])
+	}
+	return analysis, true
+}
+
+func (a *ScanAnalysis) add(other ScanAnalysis) {
+	a.TFF += other.TFF
+	a.BFF += other.BFF
+	a.Progressive += other.Progressive
+	a.Undetermined += other.Undetermined
+	a.RepeatedTop += other.RepeatedTop
+	a.RepeatedBottom += other.RepeatedBottom
+	a.RepeatedNeither += other.RepeatedNeither
+}
+
+// repeated is the share of frames idet found repeating a field.
+func (a ScanAnalysis) repeated() float64 {
+	frames := a.RepeatedTop + a.RepeatedBottom + a.RepeatedNeither
+	if frames == 0 {
+		return 0
+	}
+	return float64(a.RepeatedTop+a.RepeatedBottom) / float64(frames)
+}
+
+// classify calls a source combed in at least threshold of the frames idet decided on interlaced,
+// or telecined when only part of them are combed and idet saw the repeated fields hard pulldown leaves.
+// Partly combed frames without repeated fields are not pulldown, decimating them would drop real frames.
+func (a ScanAnalysis) classify(threshold float64) string {
+	determined := a.TFF + a.BFF + a.Progressive
+	if determined == 0 {
+		return ""
+	}
+
+	combed := float64(a.TFF+a.BFF) / float64(determined)
+	if combed < threshold {
+		return SCAN_PROGRESSIVE
+	} else if combed < TELECINE_MAX_INTERLACED && a.repeated() >= TELECINE_MIN_REPEATED {
+		return SCAN_TELECINED
+	}
+	return SCAN_INTERLACED
+}
+
+// parity is the field order idet saw most, falling back to what the stream signals.
+func (a ScanAnalysis) parity(fieldOrder string) string {
+	if a.TFF > a.BFF {
+		return "tff"
+	} else if a.BFF > a.TFF {
+		return "bff"
+	}
+	return fieldParity(fieldOrder)
+}
+
+func fieldParity(fieldOrder string) string {
+	switch fieldOrder {
+	case "tt", "tb":
+		return "tff"
+	case "bb", "bt":
+		return "bff"
+	default:
+		return "auto"
+	}
+}
+
+// fieldOrderScan is the scan type a probe field_order implies when idet could not decide.
+func fieldOrderScan(fieldOrder string) string {
+	if fieldParity(fieldOrder) != "auto" {
+		return SCAN_INTERLACED
+	}
+	return SCAN_PROGRESSIVE
+}
+
+// filter turns frames of the given scan into progressive ones, "" for progressive sources.
+// Telecined film is field matched back to its original frames and decimated to the film rate,
+// stray combed frames the match leaves behind are deinterlaced on their own.
+func (p *DeinterlacePolicy) filter(scan, parity string) string {
+	switch scan {
+	case SCAN_INTERLACED:
+		return p.Filter + "=mode=send_frame:parity=" + parity + ":deint=all"
+	case SCAN_TELECINED:
+		return "fieldmatch=order=" + parity + ":combmatch=full," + p.Filter + "=mode=send_frame:parity=" + parity + ":deint=interlaced,decimate"
+	default:
+		return ""
+	}
+}
+
+// detectScan classifies the video stream of movie, sources the probe reports as progressive are taken at their word.
+func detectScan(ctx context.Context, executor Executor, policy *DeinterlacePolicy, worker *Worker, movie string, probe *Probe, videoStream *Stream) (scan, parity string, err error) {
+	if videoStream.FieldOrder == SCAN_PROGRESSIVE {
+		return SCAN_PROGRESSIVE, "", nil
+	}
+
+	duration, _ := probe.Duration()
+	var analysis ScanAnalysis
+	for _, start := range sampleOffsets(duration, policy.Samples, policy.Length.Duration) {
+		ffmpeg, ffmpegArgs := worker.command("ffmpeg",
+			"-nostdin", "-hide_banner", "-nostats",
+			"-ss", strconv.FormatFloat(start.Seconds(), 'f', 3, 64),
+			"-t", strconv.FormatFloat(policy.Length.Duration.Seconds(), 'f', 3, 64),
+			"-i", movie,
+			"-map", "0:"+strconv.Itoa(videoStream.Index),
+			"-vf", "idet",
+			"-f", "null", "-")
+
+		stderr, err := executor.Run(ctx, ioutil.Discard, ffmpeg, ffmpegArgs...)
+		if err != nil {
+			return "", "", err
+		}
+
+		if sample, ok := parseIdet(stderr); ok {
+			analysis.add(sample)
+		}
+	}
+
+	if scan = analysis.classify(policy.Threshold); scan == "" {
+		scan = fieldOrderScan(videoStream.FieldOrder)
+	}
+	return scan, analysis.parity(videoStream.FieldOrder), nil
+}
@@ -0,0 +1,100 @@
+//By TimTheSinner
+package main
+
+import (
+	"testing"
+)
+
+/**
+ * Copyright (c) 2016 TimTheSinner All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// idet summaries of a 1080i broadcast and of hard telecined film
+const (
+	IDET_INTERLACED = `[Parsed_idet_0 @ 0x1] Repeated Fields: Neither:   241 Top:     0 Bottom:     0
+[Parsed_idet_0 @ 0x1] Single frame detection: TFF:   180 BFF:     0 Progressive:    12 Undetermined:    49
+[Parsed_idet_0 @ 0x1] Multi frame detection: TFF:   236 BFF:     0 Progressive:     2 Undetermined:     3
+`
+	IDET_TELECINED = `[Parsed_idet_0 @ 0x1] Repeated Fields: Neither:   236 Top:    34 Bottom:    30
+[Parsed_idet_0 @ 0x1] Single frame detection: TFF:    90 BFF:     0 Progressive:   170 Undetermined:    40
+[Parsed_idet_0 @ 0x1] Multi frame detection: TFF:   118 BFF:     2 Progressive:   178 Undetermined:     2
+`
+)
+
+func TestParseIdet(t *testing.T) {
+	analysis, ok := parseIdet(IDET_INTERLACED)
+	if !ok || analysis != (ScanAnalysis{TFF: 236, BFF: 0, Progressive: 2, Undetermined: 3, RepeatedNeither: 241}) {
+		t.Errorf("Expected the multi frame summary, got %+v %v", analysis, ok)
+	}
+
+	if _, ok := parseIdet("frame=  240 fps=0.0 q=-0.0 size=N/A\n"); ok {
+		t.Error("Expected no analysis without an idet summary")
+	}
+}
+
+func TestClassifyScan(t *testing.T) {
+	interlaced, _ := parseIdet(IDET_INTERLACED)
+	telecined, _ := parseIdet(IDET_TELECINED)
+	tests := []struct {
+		analysis ScanAnalysis
+		expected string
+	}{
+		{interlaced, SCAN_INTERLACED},
+		{telecined, SCAN_TELECINED},
+		// Partly combed without repeated fields is deinterlaced rather than decimated
+		{ScanAnalysis{TFF: 118, BFF: 2, Progressive: 178, Undetermined: 2, RepeatedNeither: 300}, SCAN_INTERLACED},
+		{ScanAnalysis{TFF: 118, BFF: 2, Progressive: 178, Undetermined: 2}, SCAN_INTERLACED},
+		{ScanAnalysis{TFF: 3, Progressive: 280, Undetermined: 17}, SCAN_PROGRESSIVE},
+		{ScanAnalysis{Undetermined: 300}, ""},
+	}
+
+	for _, test := range tests {
+		if scan := test.analysis.classify(DEFAULT_DEINTERLACE_THRESHOLD); scan != test.expected {
+			t.Errorf("Expected %+v to be %q, got %q", test.analysis, test.expected, scan)
+		}
+	}
+
+	if parity := interlaced.parity("bb"); parity != "tff" {
+		t.Errorf("Expected idet to outrank the field order, got %s", parity)
+	}
+	if parity := (ScanAnalysis{}).parity("bb"); parity != "bff" {
+		t.Errorf("Expected the field order without an idet majority, got %s", parity)
+	}
+	if scan := fieldOrderScan("tt"); scan != SCAN_INTERLACED {
+		t.Errorf("Expected a top field first stream to be interlaced, got %s", scan)
+	}
+}
+
+func TestDeinterlaceFilter(t *testing.T) {
+	policy := &DeinterlacePolicy{Mode: DEINTERLACE_AUTO, Filter: "yadif"}
+	policy.applyDefaults()
+	if err := policy.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if filter := policy.filter(SCAN_INTERLACED, "tff"); filter != "yadif=mode=send_frame:parity=tff:deint=all" {
+		t.Errorf("Unexpected deinterlace %s", filter)
+	}
+	if filter := policy.filter(SCAN_TELECINED, "bff"); filter != "fieldmatch=order=bff:combmatch=full,yadif=mode=send_frame:parity=bff:deint=interlaced,decimate" {
+		t.Errorf("Unexpected inverse telecine %s", filter)
+	}
+	if filter := policy.filter(SCAN_PROGRESSIVE, ""); filter != "" {
+		t.Errorf("Expected progressive frames to pass through, got %s", filter)
+	}
+
+	if err := (&DeinterlacePolicy{Mode: DEINTERLACE_AUTO, Filter: "kerndeint"}).Validate(); err == nil {
+		t.Error("Expected an unsupported deinterlacer to be rejected")
+	}
+}
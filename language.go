@@ -0,0 +1,370 @@
+//By TimTheSinner
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+/**
+ * Copyright (c) 2016 TimTheSinner All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+const (
+	// Refuse to transcode when no wanted audio language is found
+	FALLBACK_SKIP = "skip"
+	// Keep the first audio stream when no wanted audio language is found
+	FALLBACK_FIRST = "first"
+	// Keep every audio stream when no wanted audio language is found
+	FALLBACK_ALL = "all"
+)
+
+const LANGUAGE_OVERRIDE_FILE = "transcode-languages.json"
+
+// LanguagePolicy decides which audio and subtitle streams survive a transcode, languages are kept in the order listed.
+type LanguagePolicy struct {
+	Audio            []string `json:"audio,omitempty"`
+	Subtitles        []string `json:"subtitles,omitempty"`
+	AudioFallback    string   `json:"audioFallback,omitempty"`
+	KeepUndetermined bool     `json:"keepUndetermined,omitempty"`
+}
+
+// Override returns a copy of the policy with every field set in override replacing ours.
+func (p LanguagePolicy) Override(override LanguagePolicy) LanguagePolicy {
+	if len(override.Audio) > 0 {
+		p.Audio = override.Audio
+	}
+	if len(override.Subtitles) > 0 {
+		p.Subtitles = override.Subtitles
+	}
+	if override.AudioFallback != "" {
+		p.AudioFallback = override.AudioFallback
+	}
+	if override.KeepUndetermined {
+		p.KeepUndetermined = true
+	}
+	return p
+}
+
+func (p LanguagePolicy) Validate() error {
+	if len(p.Audio) == 0 {
+		return fmt.Errorf("Language policy must list at least one audio language")
+	}
+
+	switch p.AudioFallback {
+	case "", FALLBACK_SKIP, FALLBACK_FIRST, FALLBACK_ALL:
+		return nil
+	default:
+		return fmt.Errorf("Unknown audio fallback %q, expected one of %s, %s or %s", p.AudioFallback, FALLBACK_SKIP, FALLBACK_FIRST, FALLBACK_ALL)
+	}
+}
+
+// readLanguagePolicy applies the optional transcode-languages.json override found in a library root.
+func readLanguagePolicy(mediaDir string, defaults LanguagePolicy) (LanguagePolicy, error) {
+	overrideFile, err := os.Open(filepath.Join(mediaDir, LANGUAGE_OVERRIDE_FILE))
+	if os.IsNotExist(err) {
+		return defaults, defaults.Validate()
+	} else if err != nil {
+		return defaults, err
+	}
+	defer overrideFile.Close()
+
+	var override LanguagePolicy
+	if err := json.NewDecoder(overrideFile).Decode(&override); err != nil {
+		return defaults, fmt.Errorf("Could not decode %s: %v", overrideFile.Name(), err)
+	}
+
+	policy := defaults.Override(override)
+	return policy, policy.Validate()
+}
+
+func splitLanguages(languages string) []string {
+	ret := make([]string, 0)
+	for _, language := range strings.Split(languages, ",") {
+		if language = strings.TrimSpace(language); language != "" {
+			ret = append(ret, language)
+		}
+	}
+	return ret
+}
+
+var LANGUAGES = [][]string{
+	{"eng", "en", "english"},
+	{"jpn", "ja", "japanese"},
+	{"spa", "es", "spanish", "español", "espanol"},
+	{"fre", "fra", "fr", "french", "français", "francais"},
+	{"ger", "deu", "de", "german", "deutsch"},
+	{"ita", "it", "italian", "italiano"},
+	{"por", "pt", "portuguese", "português", "portugues"},
+	{"chi", "zho", "zh", "chinese", "mandarin", "cantonese"},
+	{"kor", "ko", "korean"},
+	{"rus", "ru", "russian"},
+	{"dut", "nld", "nl", "dutch"},
+	{"swe", "sv", "swedish"},
+	{"nor", "nob", "nno", "no", "norwegian"},
+	{"dan", "da", "danish"},
+	{"fin", "fi", "finnish"},
+	{"pol", "pl", "polish"},
+	{"hin", "hi", "hindi"},
+	{"ara", "ar", "arabic"},
+}
+
+// ISO 639-1 codes by the 639-2/B code they normalize to
+var ISO_639_1 = map[string]string{
+	"aa": "aar", "ab": "abk", "ae": "ave", "af": "afr", "ak": "aka", "am": "amh", "an": "arg", "ar": "ara",
+	"as": "asm", "av": "ava", "ay": "aym", "az": "aze", "ba": "bak", "be": "bel", "bg": "bul", "bh": "bih",
+	"bi": "bis", "bm": "bam", "bn": "ben", "bo": "tib", "br": "bre", "bs": "bos", "ca": "cat", "ce": "che",
+	"ch": "cha", "co": "cos", "cr": "cre", "cs": "cze", "cu": "chu", "cv": "chv", "cy": "wel", "da": "dan",
+	"de": "ger", "dv": "div", "dz": "dzo", "ee": "ewe", "el": "gre", "en": "eng", "eo": "epo", "es": "spa",
+	"et": "est", "eu": "baq", "fa": "per", "ff": "ful", "fi": "fin", "fj": "fij", "fo": "fao", "fr": "fre",
+	"fy": "fry", "ga": "gle", "gd": "gla", "gl": "glg", "gn": "grn", "gu": "guj", "gv": "glv", "ha": "hau",
+	"he": "heb", "hi": "hin", "ho": "hmo", "hr": "hrv", "ht": "hat", "hu": "hun", "hy": "arm", "hz": "her",
+	"ia": "ina", "id": "ind", "ie": "ile", "ig": "ibo", "ii": "iii", "ik": "ipk", "io": "ido", "is": "ice",
+	"it": "ita", "iu": "iku", "ja": "jpn", "jv": "jav", "ka": "geo", "kg": "kon", "ki": "kik", "kj": "kua",
+	"kk": "kaz", "kl": "kal", "km": "khm", "kn": "kan", "ko": "kor", "kr": "kau", "ks": "kas", "ku": "kur",
+	"kv": "kom", "kw": "cor", "ky": "kir", "la": "lat", "lb": "ltz", "lg": "lug", "li": "lim", "ln": "lin",
+	"lo": "lao", "lt": "lit", "lu": "lub", "lv": "lav", "mg": "mlg", "mh": "mah", "mi": "mao", "mk": "mac",
+	"ml": "mal", "mn": "mon", "mr": "mar", "ms": "may", "mt": "mlt", "my": "bur", "na": "nau", "nb": "nob",
+	"nd": "nde", "ne": "nep", "ng": "ndo", "nl": "dut", "nn": "nno", "no": "nor", "nr": "nbl", "nv": "nav",
+	"ny": "nya", "oc": "oci", "oj": "oji", "om": "orm", "or": "ori", "os": "oss", "pa": "pan", "pi": "pli",
+	"pl": "pol", "ps": "pus", "pt": "por", "qu": "que", "rm": "roh", "rn": "run", "ro": "rum", "ru": "rus",
+	"rw": "kin", "sa": "san", "sc": "srd", "sd": "snd", "se": "sme", "sg": "sag", "si": "sin", "sk": "slo",
+	"sl": "slv", "sm": "smo", "sn": "sna", "so": "som", "sq": "alb", "sr": "srp", "ss": "ssw", "st": "sot",
+	"su": "sun", "sv": "swe", "sw": "swa", "ta": "tam", "te": "tel", "tg": "tgk", "th": "tha", "ti": "tir",
+	"tk": "tuk", "tl": "tgl", "tn": "tsn", "to": "ton", "tr": "tur", "ts": "tso", "tt": "tat", "tw": "twi",
+	"ty": "tah", "ug": "uig", "uk": "ukr", "ur": "urd", "uz": "uzb", "ve": "ven", "vi": "vie", "vo": "vol",
+	"wa": "wln", "wo": "wol", "xh": "xho", "yi": "yid", "yo": "yor", "za": "zha", "zh": "chi", "zu": "zul",
+}
+
+// ISO 639-2/T codes that differ from their 639-2/B code
+var ISO_639_2T = map[string]string{
+	"sqi": "alb", "hye": "arm", "eus": "baq", "mya": "bur", "zho": "chi", "ces": "cze", "nld": "dut", "fra": "fre",
+	"kat": "geo", "deu": "ger", "ell": "gre", "isl": "ice", "mkd": "mac", "mri": "mao", "msa": "may", "fas": "per",
+	"ron": "rum", "slk": "slo", "bod": "tib", "cym": "wel",
+}
+
+// isoLanguages is every 639-2/B code, the ones without a 639-1 code are listed here
+var isoLanguages = languageSet(`
+ace ach ada ady afa afh ain akk ale alg alt ang anp apa arc arn arp art arw ast
+ath aus awa bad bai bal ban bas bat bej bem ber bho bik bin bla bnt bra btk bua
+bug byn cad cai car cau ceb cel chb chg chk chm chn cho chp chr chy cmc cnr cop
+cpe cpf cpp crh crp csb cus dak dar day del den dgr din doi dra dsb dua dum dyu
+efi egy eka elx enm ewo fan fat fil fiu fon frm fro frr frs fur gaa gay gba gem
+gez gil gmh goh gon gor got grb grc gsw gwi hai haw hil him hit hmn hsb hup iba
+ijo ilo inc ine inh ira iro jbo jpr jrb kaa kab kac kam kar kaw kbd kha khi kho
+kmb kok kos kpe krc krl kro kru kum kut lad lah lam lez lol loz lua lui lun luo
+lus mad mag mai mak man map mas mdf mdr men mga mic min mis mkh mnc mni mno moh
+mos mul mun mus mwl mwr myn myv nah nai nap nds new nia nic niu nog non nqo nso
+nub nwc nym nyn nyo nzi osa ota oto paa pag pal pam pap pau peo phi phn pon pra
+pro raj rap rar roa rom rup sad sah sai sal sam sas sat scn sco sel sem sga sgn
+shn sid sio sit sla sma smi smj smn sms snk sog son srn srr ssa suk sus sux syc
+syr tai tem ter tet tig tiv tkl tlh tli tmh tog tpi tsi tum tup tut tvl tyv udm
+uga umb und vai vot wak wal war was wen xal yao yap ypk zap zbl zen zgh znd zun
+zxx zza`)
+
+func languageSet(codes string) map[string]bool {
+	set := make(map[string]bool)
+	for _, code := range strings.Fields(codes) {
+		set[code] = true
+	}
+	for _, code := range ISO_639_1 {
+		set[code] = true
+	}
+	return set
+}
+
+// normalizeLanguage maps ISO 639-1, 639-2/B, 639-2/T and english names onto the 639-2/B code mkv uses.
+// A region is dropped, pt-BR and en_US are taken as por and eng.
+func normalizeLanguage(language string) string {
+	language = strings.ToLower(strings.TrimSpace(language))
+	if region := strings.IndexAny(language, "-_"); region > 0 {
+		if base := language[:region]; ISO_639_1[base] != "" || isoLanguages[base] || ISO_639_2T[base] != "" {
+			language = base
+		}
+	}
+
+	for _, aliases := range LANGUAGES {
+		for _, alias := range aliases {
+			if alias == language {
+				return aliases[0]
+			}
+		}
+	}
+
+	if code, ok := ISO_639_1[language]; ok {
+		return code
+	} else if code, ok := ISO_639_2T[language]; ok {
+		return code
+	}
+	return language
+}
+
+// isLanguage reports whether language is a known language code or name.
+func isLanguage(language string) bool {
+	return isoLanguages[normalizeLanguage(language)]
+}
+
+func languageNames(language string) []string {
+	language = normalizeLanguage(language)
+	for _, aliases := range LANGUAGES {
+		if aliases[0] == language {
+			return aliases
+		}
+	}
+	return []string{language}
+}
+
+func isUndetermined(language string) bool {
+	return language == "" || language == "und" || language == "unk" || language == "zxx"
+}
+
+// SelectedStream is an input stream we are keeping along with the language it will be tagged with.
+type SelectedStream struct {
+	*Stream
+	Language string
+	Inferred bool
+	// Downmix is a stereo compatibility track encoded from the stream rather than the stream itself
+	Downmix bool
+	// Input is the ffmpeg input holding the stream, 0 is the movie and anything after is a sidecar file
+	Input int
+}
+
+type StreamSelection struct {
+	Audio     []*SelectedStream
+	Subtitles []*SelectedStream
+}
+
+// streamLanguage resolves the language of a stream from its tag, falling back to a title like "English 5.1".
+func streamLanguage(stream *Stream) (language string, inferred bool) {
+	if tagged := normalizeLanguage(stream.Language()); !isUndetermined(tagged) {
+		return tagged, false
+	}
+
+	title := strings.ToLower(stream.Title())
+	for _, aliases := range LANGUAGES {
+		for _, alias := range aliases[1:] {
+			if len(alias) > 3 && strings.HasPrefix(title, alias) {
+				return aliases[0], true
+			}
+		}
+	}
+	return "", false
+}
+
+func selectLanguages(streams []*Stream, wanted []string, keepUndetermined bool) []*SelectedStream {
+	selected := make([]*SelectedStream, 0)
+	for _, want := range wanted {
+		want = normalizeLanguage(want)
+		for _, stream := range streams {
+			if language, inferred := streamLanguage(stream); language == want {
+				selected = append(selected, &SelectedStream{Stream: stream, Language: language, Inferred: inferred})
+			}
+		}
+	}
+
+	if keepUndetermined {
+		for _, stream := range streams {
+			if language, _ := streamLanguage(stream); language == "" {
+				selected = append(selected, &SelectedStream{Stream: stream})
+			}
+		}
+	}
+	return selected
+}
+
+// SelectStreams applies the policy to a probe, verified marks a movie a human has confirmed has usable audio.
+func (p LanguagePolicy) SelectStreams(probe *Probe, verified bool) (*StreamSelection, error) {
+	audio := probe.StreamsOfType("audio")
+	selection := &StreamSelection{
+		Audio:     selectLanguages(audio, p.Audio, p.KeepUndetermined),
+		Subtitles: selectLanguages(probe.StreamsOfType("subtitle"), p.Subtitles, p.KeepUndetermined),
+	}
+
+	if len(selection.Audio) > 0 || len(audio) == 0 {
+		return selection, nil
+	}
+
+	if verified && len(audio) > 1 {
+		// Historically a verified movie keeps its first two audio streams
+		selection.Audio = selectFallback(audio[:2])
+		return selection, nil
+	} else if verified {
+		selection.Audio = selectFallback(audio)
+		return selection, nil
+	}
+
+	switch p.AudioFallback {
+	case FALLBACK_FIRST:
+		selection.Audio = selectFallback(audio[:1])
+	case FALLBACK_ALL:
+		selection.Audio = selectFallback(audio)
+	default:
+		return nil, fmt.Errorf("Did not detect any %s audio streams", strings.Join(p.Audio, ", "))
+	}
+	return selection, nil
+}
+
+func selectFallback(streams []*Stream) []*SelectedStream {
+	selected := make([]*SelectedStream, 0, len(streams))
+	for _, stream := range streams {
+		language, inferred := streamLanguage(stream)
+		selected = append(selected, &SelectedStream{Stream: stream, Language: language, Inferred: inferred})
+	}
+	return selected
+}
+
+// PrimaryLanguage is the language of the first kept audio stream, used to tag the video stream.
+func (s *StreamSelection) PrimaryLanguage() string {
+	for _, stream := range s.Audio {
+		if stream.Language != "" {
+			return stream.Language
+		}
+	}
+	return ""
+}
+
+// MapArgs maps the selected streams in policy order, only writing a language tag when it was inferred from the title or file name.
+func (s *StreamSelection) MapArgs() []string {
+	args := make([]string, 0)
+	for _, stream := range s.Audio {
+		args = append(args, "-map", strconv.Itoa(stream.Input)+":"+strconv.Itoa(stream.Index))
+	}
+	for _, stream := range s.Subtitles {
+		args = append(args, "-map", strconv.Itoa(stream.Input)+":"+strconv.Itoa(stream.Index))
+	}
+
+	for i, stream := range s.Audio {
+		if stream.Inferred {
+			args = append(args, "-metadata:s:a:"+strconv.Itoa(i), "language="+stream.Language)
+		}
+	}
+	for i, stream := range s.Subtitles {
+		spec := ":s:" + strconv.Itoa(i)
+		if stream.Inferred {
+			args = append(args, "-metadata:s"+spec, "language="+stream.Language)
+		}
+		if stream.Input > 0 {
+			args = append(args, "-disposition"+spec, sidecarDisposition(stream.Stream))
+			if title := sidecarTitle(stream.Stream); title != "" {
+				args = append(args, "-metadata:s"+spec, "title="+title)
+			}
+		}
+	}
+	return args
+}
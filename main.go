@@ -2,20 +2,21 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
-	"math/rand"
+	"net/http"
 	"os"
-	"path"
+	"os/signal"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
+	"text/tabwriter"
 	"time"
-
-	"github.com/fsnotify/fsnotify"
 )
 
 /**
@@ -40,6 +41,11 @@ type Transcode struct {
 	OriginalCodec     string `json:"originalCodec"`
 	OriginalWidth     int    `json:"originalWidth"`
 	OriginalPixFormat string `json:"originalPixFormat"`
+	OriginalHDR       string `json:"originalHDR,omitempty"`
+
+	// Set once the retention policy has deleted the original, or moved it to OriginalTrash
+	OriginalDiscarded *time.Time `json:"originalDiscarded,omitempty"`
+	OriginalTrash     string     `json:"originalTrash,omitempty"`
 
 	TranscodedMovie string `json:"transcodedFile"`
 	TranscodedCodec string `json:"transcodedCodec"`
@@ -47,9 +53,39 @@ type Transcode struct {
 	TranscodedSize  int64  `json:"transcodedSize"`
 	TranscodedSpeed string `json:"transcodedSpeed"`
 	TranscodeCRF    int    `json:"transcodedCRF"`
+	Profile         string `json:"profile,omitempty"`
 
 	TranscodedBitrate  string `json:"transcodedBitrate"`
 	TranscodedDuration string `json:"transcodedDuration"`
+	TranscodedHDR      string `json:"transcodedHDR,omitempty"`
+	// The tonemap curve an HDR original was mapped into SDR with
+	Tonemapped string `json:"tonemapped,omitempty"`
+
+	// How idet classified the original's frames, empty when it was not analyzed
+	Scan string `json:"scan,omitempty"`
+	// The black bars cropped from the original, nil when the picture filled the frame
+	Crop *Crop `json:"crop,omitempty"`
+	// The -vf chain the original was encoded through
+	VideoFilters string `json:"videoFilters,omitempty"`
+
+	// Subtitle files from beside the original that were muxed into the transcode
+	SidecarSubtitles []string `json:"sidecarSubtitles,omitempty"`
+	// Embedded text subtitles written out beside the transcode, and bitmap ones that could not be
+	ExtractedSubtitles []*ExtractedSubtitle `json:"extractedSubtitles,omitempty"`
+
+	Verification *Verification     `json:"verification,omitempty"`
+	Failure      *TranscodeFailure `json:"failure,omitempty"`
+	Episode      *Episode          `json:"episode,omitempty"`
+
+	// When the last transcode attempt finished, successful or not
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+func (t *Transcode) Status() string {
+	if t.Failure != nil {
+		return STATUS_FAILED
+	}
+	return STATUS_TRANSCODED
 }
 
 func handle(err error) {
@@ -58,55 +94,69 @@ func handle(err error) {
 	}
 }
 
-func movieAsMkv(movie string) string {
+func movieAsContainer(movie string, container string) string {
 	baseName := filepath.Base(movie)
-	return strings.TrimSuffix(baseName, filepath.Ext(baseName)) + ".mkv"
+	return strings.TrimSuffix(baseName, filepath.Ext(baseName)) + "." + container
 }
 
-func transcodedMovie(originalMovie string) string {
-	return filepath.Join(filepath.Dir(originalMovie), "transcode-"+movieAsMkv(originalMovie))
+func transcodedMovie(originalMovie string, container string) string {
+	return filepath.Join(filepath.Dir(originalMovie), "transcode-"+movieAsContainer(originalMovie, container))
 }
 
-func transcode(originalMovie string, hwaccel string, threads int, crf int, codec string) *Transcode {
+func transcode(ctx context.Context, executor Executor, originalMovie string, profile *Profile, languages LanguagePolicy, hwaccel string, worker *Worker, report ProgressFunc) (*Transcode, error) {
 	lock, err := NewLockfile(filepath.Join(filepath.Dir(originalMovie), "transcoding.lck"))
 	if err != nil {
-		return nil
+		return nil, failed(REASON_LOCKED, err)
 	}
 	defer lock.Unlock()
 
-	streams := movieMetadata(originalMovie)["streams"].([]interface{})
-	videoStream := findVideoStream(streams)
-	if videoStream == nil {
-		return nil
+	probe, err := probeMovie(ctx, executor, originalMovie)
+	if err != nil {
+		return nil, failed(REASON_PROBE, err)
 	}
 
-	scale := "scale=1920:-2"
-	width, ok := videoStream["coded_width"].(float64)
-	if !ok {
-		return nil
+	videoStream, err := probe.VideoStream()
+	if err != nil {
+		return nil, failed(REASON_PROBE, fmt.Errorf("%s: %v", originalMovie, err))
 	}
 
-	if int(width) <= 1920 {
-		scale = ""
+	if videoStream.FrameWidth() <= 0 {
+		return nil, failed(REASON_PROBE, fmt.Errorf("%s: video stream does not report a width", originalMovie))
 	}
 
-	english := FilterEnglishStreams(streams)
-	if len(english) == 0 {
-		if _, err := os.Stat(filepath.Join(filepath.Dir(originalMovie), "verified-english")); err == nil {
-			english = []string{"-map", "0:a:0", "-map", "0:a:1?"}
-		} else {
-			fmt.Println("Did not detect any english streams")
-			for i := 1; i <= 10; i++ {
-				fmt.Println("Please Verify English: " + filepath.Dir(originalMovie))
-			}
-			return nil
+	_, err = os.Stat(filepath.Join(filepath.Dir(originalMovie), "verified-english"))
+	selection, err := languages.SelectStreams(probe, err == nil)
+	if err != nil {
+		fmt.Println(err)
+		for i := 1; i <= 10; i++ {
+			fmt.Println("Please Verify Languages: " + filepath.Dir(originalMovie))
+		}
+		return nil, failed(REASON_LANGUAGES, fmt.Errorf("%s: %v", originalMovie, err))
+	}
+
+	var sidecarInputs []string
+	if !profile.keepSubtitles() {
+		selection.Subtitles = nil
+	} else if sidecars, err := findSidecars(originalMovie); err != nil {
+		return nil, failed(REASON_PROBE, err)
+	} else {
+		if profile.Container == "mp4" {
+			// mov_text cannot hold the bitmaps a VobSub sidecar carries
+			sidecars = textSidecars(sidecars)
 		}
+
+		var muxed []*SelectedStream
+		muxed, sidecarInputs = languages.selectSidecars(sidecars, selection.PrimaryLanguage(), 1)
+		selection.Subtitles = append(selection.Subtitles, muxed...)
 	}
+	selection.Audio = profile.Stereo.withStereoTracks(selection.Audio)
 
-	targetMovie := transcodedMovie(originalMovie)
+	targetMovie := transcodedMovie(originalMovie, profile.Container)
 	transcodeArgs := []string{
 		"-nostdin",
 		"-hide_banner",
+		"-nostats",
+		"-progress", "pipe:1",
 		"-avioflags", "direct",
 		"-rtbufsize", "64M",
 	}
@@ -117,152 +167,397 @@ func transcode(originalMovie string, hwaccel string, threads int, crf int, codec
 
 	transcodeArgs = append(transcodeArgs,
 		"-analyzeduration", "512M", "-probesize", "512M", "-fix_sub_duration",
-		"-i", originalMovie,
+		"-i", originalMovie)
+
+	for _, sidecar := range sidecarInputs {
+		transcodeArgs = append(transcodeArgs, "-i", sidecar)
+	}
+
+	transcodeArgs = append(transcodeArgs,
 		"-max_muxing_queue_size", "65536",
 		"-map_metadata:g", "0:g",
 		"-map_metadata:s:v", "0:s:v")
 
-	if HasAttachmentStreams(streams) {
+	// Attachments (fonts for styled subtitles) can only be carried by mkv
+	attachments := profile.Container == "mkv" && probe.HasAttachmentStreams()
+	if attachments {
 		transcodeArgs = append(transcodeArgs, "-map_metadata:s:t", "0:s:t")
 	}
 
-	transcodeArgs = append(append(append(transcodeArgs, "-map", "0:v:0"), english...),
-		"-map", "0:t?",
-		"-c:v", codec)
+	transcodeArgs = append(append(transcodeArgs, "-map", "0:"+strconv.Itoa(videoStream.Index)), selection.MapArgs()...)
+	if attachments {
+		transcodeArgs = append(transcodeArgs, "-map", "0:t?")
+	}
+
+	scan, parity := "", ""
+	if profile.Deinterlace.Mode == DEINTERLACE_AUTO {
+		if scan, parity, err = detectScan(ctx, executor, profile.Deinterlace, worker, originalMovie, probe, videoStream); errors.Is(err, context.Canceled) {
+			return nil, err
+		} else if err != nil {
+			fmt.Println("Could not detect interlacing in", originalMovie, err)
+		} else if deinterlace := profile.Deinterlace.filter(scan, parity); deinterlace != "" {
+			fmt.Printf("%s is %s, filtering with %s\n", originalMovie, scan, deinterlace)
+		}
+	}
+
+	var crop *Crop
+	if profile.Crop != nil {
+		if crop, err = detectCrop(ctx, executor, profile.Crop, worker, originalMovie, probe, videoStream); errors.Is(err, context.Canceled) {
+			return nil, err
+		} else if err != nil {
+			fmt.Println("Could not detect black bars in", originalMovie, err)
+		} else if crop != nil {
+			fmt.Printf("Cropping %s to %s\n", originalMovie, crop)
+		}
+	}
+
+	// HDR the profile cannot keep is tonemapped into the SDR pixel format
+	source := hdrMetadata(videoStream)
+	hdr, pixFmt := profile.hdrEncoding(source)
+	tonemap := ""
+	if source != nil && hdr == nil {
+		tonemap = profile.Tonemap.filter(source, pixFmt)
+	}
+
+	graph := profile.filterGraph(videoStream, scan, parity, crop, tonemap)
+	transcodeArgs = append(transcodeArgs, "-c:v", profile.VideoCodec)
+	transcodeArgs = append(transcodeArgs, graph.Args()...)
 
-	if scale != "" {
-		transcodeArgs = append(transcodeArgs, "-vf", scale)
+	transcodeArgs = append(transcodeArgs, "-crf", strconv.Itoa(profile.Quality), "-preset", profile.Preset, "-pix_fmt", pixFmt)
+	if hdr != nil {
+		transcodeArgs = append(transcodeArgs, hdr.encoderArgs(profile.VideoCodec)...)
+	}
+
+	tonemapped := ""
+	if tonemap != "" {
+		tonemapped = profile.Tonemap.Algorithm
+		transcodeArgs = append(transcodeArgs, SDR_COLOR_ARGS...)
+	}
+	if profile.Tune != "" {
+		transcodeArgs = append(transcodeArgs, "-tune", profile.Tune)
+	}
+	transcodeArgs = append(transcodeArgs, "-movflags", "+faststart")
+
+	transcodeArgs = append(transcodeArgs, profile.audioArgs(selection.Audio)...)
+
+	if len(selection.Subtitles) > 0 {
+		transcodeArgs = append(transcodeArgs, "-c:s", profile.subtitleCodec())
 	}
 
 	transcodeArgs = append(transcodeArgs,
-		"-crf", strconv.Itoa(crf), "-preset", *speed, "-pix_fmt", *pixFmt, "-tune", "fastdecode", "-movflags", "+faststart",
-		"-c:a", "libopus", "-b:a", "256k", "-vbr", "on", "-af", "aformat=channel_layouts='7.1|6.1|5.1|stereo'", "-compression_level", "10", "-frame_duration", "10",
-		"-c:s", *subtitleCodec,
-		"-metadata:s:a", "language=eng",
-		"-metadata:s:s", "language=eng",
-		"-metadata:s:v", "language=eng",
-		"-metadata:s:v", "title="+filepath.Base(filepath.Dir(originalMovie)),
+		"-metadata:s:v", "title="+mediaTitle(originalMovie),
 		"-metadata:s:v", "description=Encoded by https://github.com/timthesinner/go-media-transcoder")
 
-	if threads > 0 {
-		transcodeArgs = append(transcodeArgs, "-threads", strconv.Itoa(threads))
+	if language := selection.PrimaryLanguage(); language != "" {
+		transcodeArgs = append(transcodeArgs, "-metadata:s:v", "language="+language)
+	}
+
+	if worker.Threads > 0 {
+		transcodeArgs = append(transcodeArgs, "-threads", strconv.Itoa(worker.Threads))
 	}
 
 	transcodeArgs = append(transcodeArgs, targetMovie)
 
-	runCommand("rm", "-f", targetMovie)
-	if !runCommand("ffmpeg", transcodeArgs...) {
-		return nil
+	if err := os.Remove(targetMovie); err != nil && !os.IsNotExist(err) {
+		return nil, failed(REASON_FFMPEG, err)
 	}
 
-	//rawMovie := "NOT-PRESERVED"
-	// Preserve the original movie only if it is greater than 1920 (1080P)
-	/*if int(videoStream["coded_width"].(float64)) > 1920 {
-		rawMovie = originalMovie + "-orig"
-		runCommand("mv", originalMovie, rawMovie)
-	} else {
-		runCommand("rm", "-f", originalMovie)
-	}*/
+	// Without a duration progress is still reported, just without a percentage or ETA
+	duration, _ := probe.Duration()
+	movieProgress := func(progress *Progress) {
+		progress.Movie = originalMovie
+		progress.Worker = worker.String()
+		if report != nil {
+			report(progress)
+		}
+	}
+
+	ffmpeg, ffmpegArgs := worker.command("ffmpeg", transcodeArgs...)
+	if err := runCommandProgress(ctx, executor, duration, movieProgress, ffmpeg, ffmpegArgs...); err != nil {
+		// Never leave a half written transcode behind
+		if err := os.Remove(targetMovie); err != nil && !os.IsNotExist(err) {
+			fmt.Println("Could not remove partial transcode", targetMovie, err)
+		}
 
-	// Until we are comfortable with the settings always Preserve
+		if errors.Is(err, context.Canceled) {
+			return nil, err
+		}
+		return nil, failed(REASON_FFMPEG, err)
+	}
+
+	var verification *Verification
+	if profile.Verify != nil {
+		if verification, err = verifyTranscode(ctx, executor, profile.Verify, worker, originalMovie, probe, selection, graph, targetMovie); err != nil {
+			// Refuse the swap, the original stays exactly where it was
+			if err := os.Remove(targetMovie); err != nil && !os.IsNotExist(err) {
+				fmt.Println("Could not remove rejected transcode", targetMovie, err)
+			}
+
+			if errors.Is(err, context.Canceled) {
+				return nil, err
+			}
+			return nil, failed(REASON_VERIFY, err)
+		}
+		fmt.Printf("Verified %s: ssim=%.4f psnr=%.2f drift=%s\n", originalMovie, verification.SSIM, verification.PSNR, verification.DurationDrift)
+	}
+
+	var subtitles []*ExtractedSubtitle
+	if profile.ExtractSubtitles {
+		target := filepath.Join(filepath.Dir(originalMovie), movieAsContainer(originalMovie, profile.Container))
+		if subtitles, err = extractSubtitles(ctx, executor, worker, originalMovie, target, selection.Subtitles); errors.Is(err, context.Canceled) {
+			os.Remove(targetMovie)
+			return nil, err
+		} else if err != nil {
+			fmt.Println("Could not extract subtitles from", originalMovie, err)
+		}
+
+		for _, subtitle := range subtitles {
+			if subtitle.Error != "" {
+				fmt.Printf("Subtitle stream %d of %s was not extracted: %s\n", subtitle.Stream, originalMovie, subtitle.Error)
+			}
+		}
+	}
+
+	transcodedInfo, err := os.Stat(targetMovie)
+	if err != nil {
+		return nil, failed(REASON_REPLACE, err)
+	}
+
+	// Always preserve the original, the library retention policy decides when it is discarded
 	rawMovie := originalMovie + "-orig"
-	handle(os.Rename(originalMovie, rawMovie))
+	if _, err := os.Lstat(rawMovie); !os.IsNotExist(err) {
+		// Never overwrite an original kept from an earlier transcode
+		if err := os.Remove(targetMovie); err != nil && !os.IsNotExist(err) {
+			fmt.Println("Could not remove transcode", targetMovie, err)
+		}
+		return nil, failed(REASON_REPLACE, fmt.Errorf("%s already exists", rawMovie))
+	}
+	if err := os.Rename(originalMovie, rawMovie); err != nil {
+		return nil, failed(REASON_REPLACE, err)
+	}
 
 	// Move the transcoded movie over the original
-	originalMovie = filepath.Join(filepath.Dir(originalMovie), movieAsMkv(originalMovie))
-	handle(os.Rename(targetMovie, originalMovie))
-	info, err := os.Stat(originalMovie)
-	handle(err)
+	sourceMovie := originalMovie
+	originalMovie = filepath.Join(filepath.Dir(originalMovie), movieAsContainer(originalMovie, profile.Container))
+	if err := os.Rename(targetMovie, originalMovie); err != nil {
+		// Put the original back so the library is never left without the movie
+		if restoreErr := os.Rename(rawMovie, sourceMovie); restoreErr != nil {
+			fmt.Println("Could not restore", sourceMovie, restoreErr)
+		}
+		return nil, failed(REASON_REPLACE, err)
+	}
 
-	transcodedMetadata := movieMetadata(originalMovie)
-	transcodedFormat := transcodedMetadata["format"].(map[string]interface{})
-	duration, _ := time.ParseDuration(transcodedFormat["duration"].(string) + "s")
-	transcodedStream := transcodedMetadata["streams"].([]interface{})[0].(map[string]interface{})
-	return &Transcode{
+	// The swap is done, from here on the movie is transcoded whatever else goes wrong
+	transcoded := &Transcode{
 		OriginalMovie:     filepath.Base(rawMovie),
-		OriginalCodec:     videoStream["codec_name"].(string),
-		OriginalWidth:     int(videoStream["width"].(float64)),
-		OriginalPixFormat: videoStream["pix_fmt"].(string),
+		OriginalCodec:     videoStream.CodecName,
+		OriginalWidth:     videoStream.Width,
+		OriginalPixFormat: videoStream.PixFmt,
+		OriginalHDR:       videoStream.HDRFormat(),
 
 		TranscodedMovie: filepath.Base(originalMovie),
-		TranscodedCodec: transcodedStream["codec_name"].(string),
-		TranscodedWidth: int(transcodedStream["width"].(float64)),
 		//TranscodedHash:  md5FromFile(originalMovie),
-		TranscodedSize:     info.Size(),
-		TranscodedSpeed:    *speed,
-		TranscodeCRF:       crf,
-		TranscodedDuration: duration.String(),
-		TranscodedBitrate:  transcodedFormat["bit_rate"].(string),
+		TranscodedSize:     transcodedInfo.Size(),
+		TranscodedSpeed:    profile.Preset,
+		TranscodeCRF:       profile.Quality,
+		Profile:            profile.Name,
+		Tonemapped:         tonemapped,
+		Crop:               crop,
+		Scan:               scan,
+		VideoFilters:       graph.String(),
+		Verification:       verification,
+		SidecarSubtitles:   sidecarNames(sidecarInputs),
+		ExtractedSubtitles: subtitles,
+	}
+
+	transcodedProbe, err := probeMovie(ctx, executor, originalMovie)
+	if err != nil {
+		fmt.Println("Could not probe transcoded", originalMovie, err)
+		return transcoded, nil
+	}
+	transcoded.TranscodedBitrate = transcodedProbe.Format.BitRate
+
+	// A missing duration should not fail an otherwise successful transcode
+	if duration, err := transcodedProbe.Duration(); err == nil {
+		transcoded.TranscodedDuration = duration.String()
 	}
-}
 
-func movieMetadata(movie string) (metadata map[string]interface{}) {
-	rawMetadata := runCommandOutput("ffprobe", "-v", "quiet", "-print_format", "json", "-show_format", "-show_streams", movie)
-	json.Unmarshal([]byte(rawMetadata), &metadata)
-	return
+	if transcodedStream, err := transcodedProbe.VideoStream(); err == nil {
+		transcoded.TranscodedCodec = transcodedStream.CodecName
+		transcoded.TranscodedWidth = transcodedStream.Width
+		transcoded.TranscodedHDR = transcodedStream.HDRFormat()
+	} else {
+		fmt.Println("Could not read the video stream of", originalMovie, err)
+	}
+	return transcoded, nil
 }
 
-func readMetadata(mediaDir string) (ret map[string]*Transcode) {
-	mediaMeta, err := os.Open(path.Join(mediaDir, "transcode-metadata.json"))
-	if err != nil {
-		return make(map[string]*Transcode)
+// MovieProcessor transcodes everything in a movie directory that has not been transcoded yet.
+type MovieProcessor func(ctx context.Context, worker *Worker, movieDir string, report ProgressFunc) (JobState, error)
+
+func movieProcessor(config *Config, library *Library, executor Executor) MovieProcessor {
+	processMovie := func(ctx context.Context, worker *Worker, movieDir string, report ProgressFunc) (JobState, error) {
+		movies, err := mediaFiles(movieDir)
+		if os.IsNotExist(err) {
+			return JOB_SKIPPED, err
+		} else if err != nil {
+			return JOB_FAILED, err
+		}
+
+		fmt.Println(worker, "Processing:", filepath.Base(movieDir))
+
+		var failure, skipped error
+		var retryAt time.Time
+		for _, movie := range movies {
+			if ctx.Err() != nil {
+				return JOB_SKIPPED, ctx.Err()
+			}
+
+			err := processFile(ctx, executor, config, library, worker, movie, report)
+			var skip *skipError
+			var later *retryLater
+			if errors.Is(err, context.Canceled) {
+				return JOB_SKIPPED, err
+			} else if errors.As(err, &later) && (retryAt.IsZero() || later.retryAt.Before(retryAt)) {
+				retryAt = later.retryAt
+			}
+
+			if errors.As(err, &skip) {
+				skipped = err
+			} else if err != nil {
+				failure = err
+			}
+		}
+
+		state, err := JOB_DONE, error(nil)
+		if failure != nil {
+			state, err = JOB_FAILED, failure
+		} else if skipped != nil {
+			state, err = JOB_SKIPPED, skipped
+		}
+
+		if !retryAt.IsZero() {
+			// The earliest movie due again decides when the directory is queued next
+			return state, &retryLater{err, retryAt}
+		}
+		return state, err
 	}
-	defer mediaMeta.Close()
 
-	json.NewDecoder(mediaMeta).Decode(&ret)
-	return
+	return processMovie
 }
 
-func writeMetadata(mediaDir string, meta *Transcode) map[string]*Transcode {
-	mediaMetadata := readMetadata(mediaDir)
-	mediaMetadata[meta.Movie] = meta
+// skipError is returned for a movie held back from this run, its job is skipped rather than done.
+type skipError struct {
+	reason string
+}
 
-	mediaMeta, err := os.OpenFile(path.Join(mediaDir, "transcode-metadata.json"), os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0644)
-	handle(err)
-	defer mediaMeta.Close()
+func (e *skipError) Error() string {
+	return e.reason
+}
+
+// retryLater marks a movie the retry policy wants to try again at retryAt.
+type retryLater struct {
+	err     error
+	retryAt time.Time
+}
 
-	json.NewEncoder(mediaMeta).Encode(mediaMetadata)
-	return mediaMetadata
+func (e *retryLater) Error() string {
+	if e.err == nil {
+		return ""
+	}
+	return e.err.Error()
+}
+
+func (e *retryLater) Unwrap() error {
+	return e.err
 }
 
-func movieProcessor(mediaDir string) func(os.FileInfo) {
-	mediaMetadata := readMetadata(mediaDir)
-	processMovie := func(movieName os.FileInfo) {
-		if !movieName.IsDir() {
-			return
+// processFile transcodes a single media file unless its metadata says it is done or not due for a retry.
+func processFile(ctx context.Context, executor Executor, config *Config, library *Library, worker *Worker, movie string, report ProgressFunc) error {
+	file, err := os.Stat(movie)
+	if os.IsNotExist(err) {
+		// Renamed or removed since the directory was walked
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	key, err := mediaKey(library.Path, movie)
+	if err != nil {
+		return err
+	}
+
+	meta, legacyKey, err := lookupTranscode(library.store, key, file.Name())
+	if err != nil {
+		return err
+	}
+
+	if meta != nil && meta.TranscodedSize == file.Size() {
+		return nil
+	}
+
+	if meta != nil && meta.Failure != nil && meta.Failure.OriginalSize == file.Size() {
+		if next, retry := config.Retry.NextAttempt(meta.Failure); !retry {
+			fmt.Printf("Gave up on %s after %d attempts: %s\n", movie, meta.Failure.Attempts, meta.Failure.Error)
+			return fmt.Errorf("Gave up on %s after %d attempts: %s", filepath.Base(movie), meta.Failure.Attempts, meta.Failure.Error)
+		} else if time.Now().Before(next) {
+			fmt.Println("Not retrying", movie, "until", next.Format(time.RFC3339))
+			return &retryLater{&skipError{fmt.Sprintf("Not retrying %s until %s", filepath.Base(movie), next.Format(time.RFC3339))}, next}
 		}
+	}
 
-		fmt.Println("Processing:", movieName.Name())
+	if meta != nil && meta.TranscodedMovie != "" && meta.TranscodedMovie != file.Name() {
+		// A new download replaced the movie, the old transcode is stale
+		if err := os.Remove(filepath.Join(filepath.Dir(movie), meta.TranscodedMovie)); err != nil && !os.IsNotExist(err) {
+			fmt.Println("Could not remove stale transcode", meta.TranscodedMovie, err)
+		}
+	}
 
-		movieDir := filepath.Join(mediaDir, movieName.Name())
-		files, err := ioutil.ReadDir(movieDir)
-		handle(err)
+	episode := keyEpisode(key, movie)
+	transcoded, err := transcodeWithProfile(ctx, executor, config, library, worker, movie, report)
+	if errors.Is(err, context.Canceled) {
+		return err
+	} else if err != nil {
+		fmt.Println("Failed to transcode", movie, err)
+		if transcodeErr, ok := err.(*TranscodeError); ok && transcodeErr.Reason == REASON_LOCKED {
+			// Another process holds the movie, that is not the movie's fault
+			return err
+		}
 
-		for _, file := range files {
-			if !file.IsDir() {
-				movie := filepath.Join(movieDir, file.Name())
-
-				if process, ok := PROCESS_FILE_EXTENSIONS[filepath.Ext(file.Name())]; !ok {
-					fmt.Printf("UNKNOWN FILE TYPE %s in %s\n", filepath.Ext(file.Name()), movieName.Name())
-				} else if strings.HasPrefix(file.Name(), "transcode-") {
-					continue
-				} else if process && file.Size() > MIN_FILE_SIZE {
-					if meta, ok := mediaMetadata[movieName.Name()]; !ok || (meta.TranscodedSize != file.Size()) {
-						if ok {
-							runCommand("rm", "-f", meta.TranscodedMovie)
-						}
-
-						if meta = transcode(movie, *hwaccel, *threads, *crf, *codec); meta != nil {
-							meta.Movie = movieName.Name()
-							mediaMetadata = writeMetadata(mediaDir, meta)
-						}
-					}
-				}
-			}
+		record := &Transcode{}
+		if meta != nil {
+			record = meta
+		}
+		record.Movie = key
+		record.Episode = episode
+		record.Failure = recordFailure(record.Failure, err, file.Size())
+		record.UpdatedAt = time.Now()
+
+		if putErr := putTranscode(library.store, record, legacyKey); putErr != nil {
+			fmt.Println("Could not record failure for", movie, putErr)
+		} else if next, retry := config.Retry.NextAttempt(record.Failure); retry {
+			return &retryLater{err, next}
 		}
+		return err
 	}
 
-	return processMovie
+	transcoded.Movie = key
+	transcoded.Episode = episode
+	transcoded.UpdatedAt = time.Now()
+	applyRetention(library, filepath.Dir(movie), transcoded)
+	if err := putTranscode(library.store, transcoded, legacyKey); err != nil {
+		fmt.Println("Could not record transcode of", movie, err)
+		return err
+	}
+	return nil
+}
+
+func transcodeWithProfile(ctx context.Context, executor Executor, config *Config, library *Library, worker *Worker, movie string, report ProgressFunc) (*Transcode, error) {
+	profile, err := config.ProfileFor(library, filepath.Dir(movie))
+	if err != nil {
+		return nil, failed(REASON_PROFILE, err)
+	}
+	return transcode(ctx, executor, movie, profile, library.Languages, *hwaccel, worker, report)
 }
 
 var PROCESS_FILE_EXTENSIONS = map[string]bool{
@@ -287,6 +582,11 @@ var PROCESS_FILE_EXTENSIONS = map[string]bool{
 	".lck": false,
 
 	".srt":      false,
+	".ass":      false,
+	".ssa":      false,
+	".vtt":      false,
+	".idx":      false,
+	".sub":      false,
 	".nfo":      false,
 	".jpg":      false,
 	".DS_Store": false,
@@ -297,112 +597,183 @@ var PROCESS_FILE_EXTENSIONS = map[string]bool{
 const MIN_FILE_SIZE = 256 * 1024 * 1024
 
 var hwaccel = flag.String("hwaccel", "", "Hardware Acceleration Driver")
-var threads = flag.Int("threads", 0, "Number of threads")
+var threads = flag.Int("threads", 0, "Number of threads per worker")
+var workerCount = flag.Int("workers", 1, "Number of concurrent transcode workers")
 var crf = flag.Int("crf", 20, "CRF (Quality Factor)")
 var codec = flag.String("codec", "hevc_amf", "Video encoding codec")
 var speed = flag.String("speed", "placebo", "Encoder speed")
 var pixFmt = flag.String("pix_fmt", "yuv420p", "Video color depth, dont go deeper than yuv420p if your encoding for a pi")
 var subtitleCodec = flag.String("subtitle-codec", "copy", "Codec to use when interacting with the subtitles stream")
+var audioLanguages = flag.String("audio-languages", "eng", "Comma separated audio languages to keep, in preferred order")
+var subtitleLanguages = flag.String("subtitle-languages", "eng", "Comma separated subtitle languages to keep, in preferred order")
+var audioPassthrough = flag.String("audio-passthrough", "truehd,"+AUDIO_DTS_HD+",flac", "Comma separated audio formats copied instead of transcoded")
+var stereoCodec = flag.String("stereo-codec", "", "Add a stereo downmix of every multichannel audio track, encoded with aac or libopus")
+var defaultAudio = flag.String("default-audio", DEFAULT_AUDIO_ORIGINAL, "Audio track flagged default when adding stereo downmixes: original or stereo")
+var extractSubtitlesFlag = flag.Bool("extract-subtitles", false, "Write every kept embedded text subtitle to an srt beside the transcode")
+var hdrMode = flag.String("hdr", HDR_PRESERVE, "HDR handling: preserve keeps HDR10 and HLG when the codec can carry it, sdr encodes everything SDR")
+var tonemapAlgorithm = flag.String("tonemap", "hable", "Curve HDR sources are tonemapped into SDR with (hable, mobius, reinhard, clip, linear, gamma) or off")
+var tonemapPeak = flag.Float64("tonemap-peak", 0, "Override the HDR peak as a multiple of 100 cd/m2, 0 reads it from the source")
+var deinterlaceMode = flag.String("deinterlace", DEINTERLACE_AUTO, "Interlace handling: auto detects interlaced and telecined sources with idet and fixes them, off encodes frames as they are")
+var cropDetect = flag.Bool("crop", false, "Detect black bars with a cropdetect pass and crop them before scaling")
+var audioFallback = flag.String("audio-fallback", FALLBACK_SKIP, "What to keep when no wanted audio language is found (skip, first or all)")
+var configFile = flag.String("config", "", "JSON config file defining profiles and libraries")
+var profileName = flag.String("profile", DEFAULT_PROFILE, "Profile used for libraries that do not name one")
+var httpAddr = flag.String("http", "", "Address to serve the JSON API on, for example :8080")
+var queuePath = flag.String("queue", "", "Job queue database, defaults to "+QUEUE_FILE+" in the first library")
+var verify = flag.Bool("verify", false, "Compare every encode against its original before replacing it")
+var keepOriginals = flag.String("keep-originals", KEEP_FOREVER, "When to discard originals: forever, verified or wide")
+var keepDays = flag.Int("keep-days", 30, "Days to keep an original after its transcode is verified")
+var trashDir = flag.String("trash", "", "Move discarded originals under this directory instead of deleting them")
+var dryRun = flag.Bool("dry-run", false, "Report what cleanup would reclaim without touching anything")
+var metadataStore = flag.String("metadata-store", STORE_JSON, "Where transcode history is kept: json or bolt")
+var maxAttempts = flag.Int("max-attempts", 5, "Give up on a movie after this many failed transcodes, 0 retries forever")
+var retryBackoff = flag.Duration("retry-backoff", time.Hour, "Wait this long before retrying a failed movie, doubling after every failure")
+
+func queueFile(config *Config) string {
+	if *queuePath != "" {
+		return *queuePath
+	} else if config.Queue != "" {
+		return config.Queue
+	}
+	return filepath.Join(config.Libraries[0].Path, QUEUE_FILE)
+}
 
-func watch(processingQueue chan<- os.FileInfo, movieWatcher, rootWatcher *fsnotify.Watcher) {
-	for {
-		select {
-		case event := <-movieWatcher.Events:
-			switch event.Op {
-			case fsnotify.Remove:
-				break
-			case fsnotify.Rename:
-				break
-			default:
-				// Skip locks and active transcode operations
-				if strings.Contains(event.Name, "transcoding.lck") || strings.Contains(event.Name, "transcode-") {
-					break
-				}
-
-				fileStat, err := os.Stat(filepath.Dir(event.Name))
-				if err != nil || !fileStat.IsDir() {
-					fmt.Println("Skipping", event.Name, event.Op, err, fileStat)
-					break
-				}
-				fmt.Println("Movie file watcher updated", event.Name, event.Op, fileStat.Name())
-
-				// Give the file system a moment to quiesce
-				time.Sleep(time.Duration(10+rand.Intn(20)) * time.Second)
-				processingQueue <- fileStat
-			}
-
-		case event := <-rootWatcher.Events:
-			switch event.Op {
-			case fsnotify.Remove:
-				break
-			case fsnotify.Rename:
-				break
-			default:
-				fileStat, err := os.Stat(event.Name)
-				if err != nil || !fileStat.IsDir() {
-					break
-				}
-
-				fmt.Println("Root file watcher update", event.Name, event.Op)
-
-				if event.Op == fsnotify.Create {
-					movieWatcher.Add(event.Name)
-				}
-
-				// Give the file system a moment to quiesce
-				time.Sleep(time.Duration(10+rand.Intn(20)) * time.Second)
-				processingQueue <- fileStat
-			}
+func httpAddress(config *Config) string {
+	if *httpAddr != "" {
+		return *httpAddr
+	}
+	return config.HTTP
+}
 
-		case err := <-rootWatcher.Errors:
-			fmt.Println("Encountered error in root file watcher", err)
+// listJobs asks a running daemon for the queue, it holds the queue database so only without one is it opened here.
+func listJobs(config *Config) ([]*Job, error) {
+	if address := httpAddress(config); address != "" {
+		if jobs, err := fetchJobs(address); !errors.Is(err, ErrNoDaemon) {
+			return jobs, err
 		}
 	}
+
+	queue, err := OpenJobQueue(queueFile(config))
+	if err == ErrQueueInUse {
+		return nil, fmt.Errorf("%v, set -http on the daemon to list its jobs", err)
+	} else if err != nil {
+		return nil, err
+	}
+	defer queue.Close()
+	return queue.Jobs()
+}
+
+func printJobs(jobs []*Job) {
+	out := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(out, "ID\tSTATE\tATTEMPTS\tUPDATED\tPATH\tERROR")
+	for _, job := range jobs {
+		fmt.Fprintf(out, "%d\t%s\t%d\t%s\t%s\t%s\n", job.ID, job.State, job.Attempts, job.UpdatedAt.Format(time.RFC3339), job.Path, job.Error)
+	}
+	out.Flush()
+}
+
+var COMMANDS = map[string]bool{
+	"queue":   true,
+	"cleanup": true,
+	"migrate": true,
 }
 
 func main() {
 	flag.Parse()
 
-	mediaDir := "/Volumes/downloads/movies/"
-	if flag.NArg() > 0 {
-		mediaDir = flag.Arg(0)
+	command, libraries := "", flag.Args()
+	if len(libraries) > 0 && COMMANDS[libraries[0]] {
+		command, libraries = libraries[0], libraries[1:]
 	}
 
-	processor := movieProcessor(mediaDir)
+	if len(libraries) == 0 && *configFile == "" {
+		libraries = []string{"/Volumes/downloads/movies/"}
+	}
 
-	rootWatcher, err := fsnotify.NewWatcher()
+	config, err := readConfig(*configFile, libraries)
 	handle(err)
-	handle(rootWatcher.Add(mediaDir))
+	if len(config.Libraries) == 0 {
+		log.Fatal("No media libraries were configured")
+	}
 
-	movieWatcher, err := fsnotify.NewWatcher()
-	handle(err)
+	if command == "queue" {
+		jobs, err := listJobs(config)
+		handle(err)
+		printJobs(jobs)
+		return
+	} else if command == "migrate" {
+		handle(migrate(config))
+		return
+	}
+
+	handle(openMetadataStores(config))
+	defer closeMetadataStores(config.Libraries)
 
-	movies, err := ioutil.ReadDir(mediaDir)
+	if command == "cleanup" {
+		handle(cleanup(config, *dryRun))
+		return
+	}
+
+	queue, err := OpenJobQueue(queueFile(config))
 	handle(err)
+	defer queue.Close()
 
-	processingQueue := make(chan os.FileInfo, 2048)
+	daemon := NewDaemon(config, queue, SystemExecutor{})
+	for _, library := range config.Libraries {
+		mediaDir := library.Path
 
-	// Process all movies immediatley
-	go func() {
-		for _, movieName := range movies {
-			processingQueue <- movieName
+		watcher, err := NewRecursiveWatcher(mediaDir)
+		handle(err)
+		defer watcher.Close()
+		fmt.Println("Watching", watcher.Watched(), "directories in", mediaDir)
 
+		movies, err := ioutil.ReadDir(mediaDir)
+		handle(err)
+
+		// Queue all movies immediatley, anything already pending from a previous run keeps its place
+		for _, movieName := range movies {
 			if movieName.IsDir() {
-				handle(movieWatcher.Add(filepath.Join(mediaDir, movieName.Name())))
+				movieDir := filepath.Join(mediaDir, movieName.Name())
+				_, err := queue.Enqueue(library.Path, movieDir)
+				handle(err)
 			}
 		}
-	}()
 
-	// Start watching routines
-	go watch(processingQueue, movieWatcher, rootWatcher)
+		// Start watching routines
+		library := library
+		go watcher.Run(func(dir string) {
+			if _, err := queue.Enqueue(library.Path, dir); err != nil {
+				fmt.Println("Could not queue", dir, err)
+			}
+		})
+	}
 
-	// Start processing routine
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
 	go func() {
-		for {
-			processor(<-processingQueue)
-		}
+		fmt.Println("Received", <-signals, "stopping once running transcodes are cleaned up")
+		stop()
+		fmt.Println("Received", <-signals, "exiting immediately")
+		os.Exit(1)
 	}()
 
-	done := make(chan bool)
-	<-done
+	// Start processing routines
+	daemon.Start(ctx)
+
+	var server *http.Server
+	if address := httpAddress(config); address != "" {
+		server = serveAPI(address, daemon)
+	}
+
+	daemon.Wait()
+
+	if server != nil {
+		shutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdown)
+	}
+	fmt.Println("Stopped")
 }
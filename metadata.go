@@ -0,0 +1,191 @@
+//By TimTheSinner
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+/**
+ * Copyright (c) 2016 TimTheSinner All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+const (
+	METADATA_FILE   = "transcode-metadata.json"
+	METADATA_BACKUP = METADATA_FILE + ".bak"
+	METADATA_LOCK   = "transcode-metadata.lck"
+
+	// How long a writer waits for another process to finish with the metadata
+	METADATA_LOCK_TIMEOUT = time.Minute
+)
+
+var ErrMetadataLocked = errors.New("Timed out waiting for the metadata lock")
+
+// Guards transcode-metadata.json within this process, the lockfile guards it from other instances.
+// The lockfile alone is not enough as it treats every goroutine of this process as the owner.
+var metadataLock = sync.Mutex{}
+
+// MetadataCorruptError means neither the metadata nor its backup could be decoded,
+// processing stops rather than treating every movie in the library as untranscoded.
+type MetadataCorruptError struct {
+	File string
+	Err  error
+}
+
+func (e *MetadataCorruptError) Error() string {
+	return fmt.Sprintf("%s is corrupt and could not be recovered from %s: %v", e.File, METADATA_BACKUP, e.Err)
+}
+
+func decodeMetadata(file string) (map[string]*Transcode, error) {
+	raw, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	mediaMetadata := make(map[string]*Transcode)
+	if len(bytes.TrimSpace(raw)) == 0 {
+		return nil, errors.New("file is empty")
+	} else if err := json.Unmarshal(raw, &mediaMetadata); err != nil {
+		return nil, err
+	}
+	return mediaMetadata, nil
+}
+
+// readMetadata never sees a partial write, writers replace the file with a rename.
+// A file that does not decode is recovered from the previous generation.
+func readMetadata(mediaDir string) (map[string]*Transcode, error) {
+	file := filepath.Join(mediaDir, METADATA_FILE)
+	mediaMetadata, err := decodeMetadata(file)
+	if os.IsNotExist(err) {
+		return make(map[string]*Transcode), nil
+	} else if err == nil {
+		return mediaMetadata, nil
+	}
+
+	backup, backupErr := decodeMetadata(filepath.Join(mediaDir, METADATA_BACKUP))
+	if backupErr != nil {
+		return nil, &MetadataCorruptError{file, err}
+	}
+
+	fmt.Println("Recovered", file, "from", METADATA_BACKUP, "after:", err)
+	return backup, nil
+}
+
+// lockMetadata serialises read-modify-write of a library's metadata across goroutines and processes.
+func lockMetadata(mediaDir string) (unlock func(), err error) {
+	metadataLock.Lock()
+
+	deadline := time.Now().Add(METADATA_LOCK_TIMEOUT)
+	for {
+		lock, err := NewLockfile(filepath.Join(mediaDir, METADATA_LOCK))
+		if err == nil {
+			return func() {
+				lock.Unlock()
+				metadataLock.Unlock()
+			}, nil
+		} else if err != ErrPidMissmatch && err != ErrLockHeld {
+			metadataLock.Unlock()
+			return nil, err
+		} else if time.Now().After(deadline) {
+			metadataLock.Unlock()
+			return nil, ErrMetadataLocked
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+}
+
+// updateMetadata applies update to the library metadata under the metadata lock and saves the result.
+func updateMetadata(mediaDir string, update func(map[string]*Transcode) error) error {
+	unlock, err := lockMetadata(mediaDir)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	mediaMetadata, err := readMetadata(mediaDir)
+	if err != nil {
+		return err
+	}
+
+	if err := update(mediaMetadata); err != nil {
+		return err
+	}
+	return saveMetadata(mediaDir, mediaMetadata)
+}
+
+func writeMetadata(mediaDir string, meta *Transcode) error {
+	return updateMetadata(mediaDir, func(mediaMetadata map[string]*Transcode) error {
+		mediaMetadata[meta.Movie] = meta
+		return nil
+	})
+}
+
+// saveMetadata keeps the current generation as the backup, then swaps the new one in with a rename.
+// Callers must hold the metadata lock.
+func saveMetadata(mediaDir string, mediaMetadata map[string]*Transcode) error {
+	file := filepath.Join(mediaDir, METADATA_FILE)
+	// Only a generation that decodes is worth keeping as the backup
+	if current, err := ioutil.ReadFile(file); err == nil && len(bytes.TrimSpace(current)) > 0 && json.Valid(current) {
+		if err := writeFileAtomic(filepath.Join(mediaDir, METADATA_BACKUP), current); err != nil {
+			return err
+		}
+	}
+
+	raw, err := json.Marshal(mediaMetadata)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(file, append(raw, '\n'))
+}
+
+// writeFileAtomic writes a temp file next to file, syncs it and renames it into place.
+func writeFileAtomic(file string, raw []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+".")
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Write(raw); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), file); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
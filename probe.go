@@ -0,0 +1,215 @@
+//By TimTheSinner
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/**
+ * Copyright (c) 2016 TimTheSinner All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+var (
+	ErrNoVideoStream = errors.New("Could not find a video stream")
+	ErrNoStreams     = errors.New("Probe did not report any streams")
+)
+
+// Probe is the subset of `ffprobe -show_format -show_streams` output the transcoder relies on.
+type Probe struct {
+	Format  Format    `json:"format"`
+	Streams []*Stream `json:"streams"`
+}
+
+type Format struct {
+	Filename   string `json:"filename"`
+	FormatName string `json:"format_name"`
+	StreamsNb  int    `json:"nb_streams"`
+	Duration   string `json:"duration"`
+	Size       string `json:"size"`
+	BitRate    string `json:"bit_rate"`
+	Tags       Tags   `json:"tags"`
+}
+
+type Stream struct {
+	Index         int    `json:"index"`
+	CodecName     string `json:"codec_name"`
+	CodecLongName string `json:"codec_long_name"`
+	CodecType     string `json:"codec_type"`
+	Profile       string `json:"profile"`
+
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+	CodedWidth  int    `json:"coded_width"`
+	CodedHeight int    `json:"coded_height"`
+	PixFmt      string `json:"pix_fmt"`
+	FieldOrder  string `json:"field_order"`
+	FrameRate   string `json:"r_frame_rate"`
+
+	ColorRange     string `json:"color_range"`
+	ColorSpace     string `json:"color_space"`
+	ColorTransfer  string `json:"color_transfer"`
+	ColorPrimaries string `json:"color_primaries"`
+
+	Channels      int    `json:"channels"`
+	ChannelLayout string `json:"channel_layout"`
+	SampleRate    string `json:"sample_rate"`
+	BitRate       string `json:"bit_rate"`
+
+	Duration    string      `json:"duration"`
+	Disposition Disposition `json:"disposition"`
+	Tags        Tags        `json:"tags"`
+	SideData    []SideData  `json:"side_data_list"`
+}
+
+type Disposition struct {
+	Default         int `json:"default"`
+	Dub             int `json:"dub"`
+	Original        int `json:"original"`
+	Comment         int `json:"comment"`
+	Forced          int `json:"forced"`
+	HearingImpaired int `json:"hearing_impaired"`
+	VisualImpaired  int `json:"visual_impaired"`
+	AttachedPic     int `json:"attached_pic"`
+}
+
+// Tags are matched case insensitively by encoding/json so LANGUAGE and language both decode.
+type Tags struct {
+	Language    string `json:"language"`
+	Title       string `json:"title"`
+	HandlerName string `json:"handler_name"`
+	Filename    string `json:"filename"`
+	Mimetype    string `json:"mimetype"`
+}
+
+// SideData covers the stream side data ffprobe reports, including HDR mastering display and content light levels.
+type SideData struct {
+	SideDataType string `json:"side_data_type"`
+
+	RedX         string `json:"red_x"`
+	RedY         string `json:"red_y"`
+	GreenX       string `json:"green_x"`
+	GreenY       string `json:"green_y"`
+	BlueX        string `json:"blue_x"`
+	BlueY        string `json:"blue_y"`
+	WhitePointX  string `json:"white_point_x"`
+	WhitePointY  string `json:"white_point_y"`
+	MinLuminance string `json:"min_luminance"`
+	MaxLuminance string `json:"max_luminance"`
+
+	MaxContent int `json:"max_content"`
+	MaxAverage int `json:"max_average"`
+}
+
+func parseProbe(raw []byte) (*Probe, error) {
+	var probe Probe
+	if err := json.Unmarshal(raw, &probe); err != nil {
+		return nil, fmt.Errorf("Could not decode ffprobe output: %v", err)
+	}
+
+	if len(probe.Streams) == 0 {
+		return nil, ErrNoStreams
+	}
+
+	for _, stream := range probe.Streams {
+		if stream == nil {
+			return nil, fmt.Errorf("Probe contained an empty stream entry")
+		}
+	}
+	return &probe, nil
+}
+
+func probeMovie(ctx context.Context, executor Executor, movie string) (*Probe, error) {
+	raw, err := executor.Output(ctx, "ffprobe", "-v", "quiet", "-print_format", "json", "-show_format", "-show_streams", movie)
+	if err != nil {
+		return nil, fmt.Errorf("ffprobe failed for %s: %w", movie, err)
+	}
+
+	probe, err := parseProbe(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", movie, err)
+	}
+	return probe, nil
+}
+
+// VideoStream returns the first real video stream, skipping embedded cover art.
+func (p *Probe) VideoStream() (*Stream, error) {
+	for _, stream := range p.Streams {
+		if stream.CodecType == "video" && stream.Disposition.AttachedPic == 0 {
+			return stream, nil
+		}
+	}
+	return nil, ErrNoVideoStream
+}
+
+func (p *Probe) StreamsOfType(codecType string) []*Stream {
+	streams := make([]*Stream, 0)
+	for _, stream := range p.Streams {
+		if stream.CodecType == codecType {
+			streams = append(streams, stream)
+		}
+	}
+	return streams
+}
+
+func (p *Probe) HasAttachmentStreams() bool {
+	return len(p.StreamsOfType("attachment")) > 0
+}
+
+func (p *Probe) Duration() (time.Duration, error) {
+	return parseSeconds(p.Format.Duration)
+}
+
+func (s *Stream) Language() string {
+	return strings.ToLower(strings.TrimSpace(s.Tags.Language))
+}
+
+func (s *Stream) Title() string {
+	return strings.TrimSpace(s.Tags.Title)
+}
+
+// FrameWidth prefers the coded width, falling back to the display width for containers that do not report it.
+func (s *Stream) FrameWidth() int {
+	if s.CodedWidth > 0 {
+		return s.CodedWidth
+	}
+	return s.Width
+}
+
+func (s *Stream) SideDataOfType(sideDataType string) *SideData {
+	for i := range s.SideData {
+		if s.SideData[i].SideDataType == sideDataType {
+			return &s.SideData[i]
+		}
+	}
+	return nil
+}
+
+func parseSeconds(seconds string) (time.Duration, error) {
+	if strings.TrimSpace(seconds) == "" {
+		return 0, fmt.Errorf("Duration was not reported")
+	}
+
+	value, err := strconv.ParseFloat(seconds, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Could not parse duration %q: %v", seconds, err)
+	}
+	return time.Duration(value * float64(time.Second)), nil
+}
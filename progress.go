@@ -0,0 +1,185 @@
+//By TimTheSinner
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**
+ * Copyright (c) 2016 TimTheSinner All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Progress is one block of ffmpeg `-progress` output, times are in seconds.
+type Progress struct {
+	Movie  string `json:"movie"`
+	Worker string `json:"worker,omitempty"`
+
+	Frame     int64   `json:"frame"`
+	FPS       float64 `json:"fps"`
+	Bitrate   string  `json:"bitrate"`
+	TotalSize int64   `json:"totalSize"`
+	OutTime   float64 `json:"outTime"`
+	Speed     float64 `json:"speed"`
+
+	Duration float64 `json:"duration"`
+	Percent  float64 `json:"percent"`
+	ETA      float64 `json:"eta"`
+	Done     bool    `json:"done"`
+}
+
+type ProgressFunc func(*Progress)
+
+// parseProgress reads key=value blocks terminated by progress=continue or progress=end.
+func parseProgress(r io.Reader, duration time.Duration, report ProgressFunc) error {
+	progress := &Progress{Duration: duration.Seconds()}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		parts := strings.SplitN(strings.TrimSpace(scanner.Text()), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		key, value := parts[0], strings.TrimSpace(parts[1])
+		switch key {
+		case "frame":
+			progress.Frame, _ = strconv.ParseInt(value, 10, 64)
+		case "fps":
+			progress.FPS, _ = strconv.ParseFloat(value, 64)
+		case "bitrate":
+			progress.Bitrate = value
+		case "total_size":
+			progress.TotalSize, _ = strconv.ParseInt(value, 10, 64)
+		case "out_time_us", "out_time_ms":
+			// Despite the name out_time_ms is also reported in microseconds
+			if us, err := strconv.ParseInt(value, 10, 64); err == nil && us >= 0 {
+				progress.OutTime = float64(us) / float64(time.Second/time.Microsecond)
+			}
+		case "speed":
+			progress.Speed, _ = strconv.ParseFloat(strings.TrimSuffix(value, "x"), 64)
+		case "progress":
+			progress.Done = value == "end"
+			progress.estimate()
+			if report != nil {
+				snapshot := *progress
+				report(&snapshot)
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+func (p *Progress) estimate() {
+	if p.Duration <= 0 {
+		return
+	}
+
+	if p.Done {
+		p.Percent, p.ETA = 100, 0
+		return
+	}
+
+	p.Percent = 100 * p.OutTime / p.Duration
+	if p.Percent > 100 {
+		p.Percent = 100
+	}
+
+	if p.Speed > 0 && p.OutTime < p.Duration {
+		p.ETA = (p.Duration - p.OutTime) / p.Speed
+	} else {
+		p.ETA = 0
+	}
+}
+
+func (p *Progress) String() string {
+	eta := time.Duration(p.ETA * float64(time.Second)).Round(time.Second)
+	return fmt.Sprintf("%s %5.1f%% frame=%d fps=%.1f speed=%.2fx bitrate=%s eta=%s", p.Movie, p.Percent, p.Frame, p.FPS, p.Speed, p.Bitrate, eta)
+}
+
+// runCommandProgress runs an ffmpeg invocation that writes `-progress pipe:1` to stdout.
+func runCommandProgress(ctx context.Context, executor Executor, duration time.Duration, report ProgressFunc, command string, args ...string) error {
+	pr, pw := io.Pipe()
+	parsed := make(chan struct{})
+	go func() {
+		defer close(parsed)
+		if err := parseProgress(pr, duration, report); err != nil {
+			fmt.Println("Could not parse progress", err)
+		}
+		// Drain anything left so ffmpeg never blocks on a full pipe
+		io.Copy(ioutil.Discard, pr)
+	}()
+
+	_, err := executor.Run(ctx, pw, command, args...)
+	pw.Close()
+	<-parsed
+	return err
+}
+
+// logProgress prints progress at most once per interval, and always when the encode finishes.
+func logProgress(interval time.Duration) ProgressFunc {
+	var last time.Time
+	return func(progress *Progress) {
+		if progress.Done || time.Since(last) >= interval {
+			last = time.Now()
+			fmt.Println(progress)
+		}
+	}
+}
+
+// ProgressHub fans progress out to any number of subscribers, slow subscribers miss updates rather than stall ffmpeg.
+type ProgressHub struct {
+	lock        sync.Mutex
+	subscribers map[chan *Progress]bool
+}
+
+func NewProgressHub() *ProgressHub {
+	return &ProgressHub{subscribers: make(map[chan *Progress]bool)}
+}
+
+func (h *ProgressHub) Publish(progress *Progress) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for subscriber := range h.subscribers {
+		select {
+		case subscriber <- progress:
+		default:
+		}
+	}
+}
+
+func (h *ProgressHub) Subscribe() chan *Progress {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	subscriber := make(chan *Progress, 16)
+	h.subscribers[subscriber] = true
+	return subscriber
+}
+
+func (h *ProgressHub) Unsubscribe(subscriber chan *Progress) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	delete(h.subscribers, subscriber)
+}
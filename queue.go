@@ -0,0 +1,429 @@
+//By TimTheSinner
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+/**
+ * Copyright (c) 2016 TimTheSinner All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+type JobState string
+
+const (
+	JOB_PENDING JobState = "pending"
+	JOB_RUNNING JobState = "running"
+	JOB_DONE    JobState = "done"
+	JOB_FAILED  JobState = "failed"
+	JOB_SKIPPED JobState = "skipped"
+)
+
+const QUEUE_FILE = "transcode-queue.db"
+
+// Finished jobs older than this are dropped when the queue is opened
+const JOB_HISTORY = 30 * 24 * time.Hour
+
+var (
+	ErrJobNotFound   = errors.New("Job not found")
+	ErrJobNotPending = errors.New("Job is not pending")
+	ErrQueueInUse    = errors.New("Queue is locked by another process")
+)
+
+var (
+	// Every job keyed by its big endian id
+	jobsBucket = []byte("jobs")
+	// Pending job ids in FIFO order, valued by movie directory
+	pendingBucket = []byte("pending")
+	// Running movie directories valued by job id
+	runningBucket = []byte("running")
+)
+
+type Job struct {
+	ID       uint64   `json:"id"`
+	Library  string   `json:"library"`
+	Path     string   `json:"path"`
+	State    JobState `json:"state"`
+	Attempts int      `json:"attempts"`
+	Error    string   `json:"error,omitempty"`
+
+	CreatedAt  time.Time  `json:"createdAt"`
+	UpdatedAt  time.Time  `json:"updatedAt"`
+	StartedAt  *time.Time `json:"startedAt,omitempty"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+}
+
+func (j *Job) Finished() bool {
+	return j.State == JOB_DONE || j.State == JOB_FAILED || j.State == JOB_SKIPPED
+}
+
+// JobQueue is a FIFO of movie directories persisted in an embedded bolt database.
+type JobQueue struct {
+	db *bolt.DB
+	// Signalled whenever a job may have become available
+	wake chan struct{}
+}
+
+func jobKey(id uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, id)
+	return key
+}
+
+// OpenJobQueue opens or creates the queue, jobs that were running when we last stopped go back to pending.
+func OpenJobQueue(file string) (*JobQueue, error) {
+	db, err := bolt.Open(file, 0644, &bolt.Options{Timeout: time.Second})
+	if err == bolt.ErrTimeout {
+		return nil, ErrQueueInUse
+	} else if err != nil {
+		return nil, err
+	}
+
+	queue := &JobQueue{db: db, wake: make(chan struct{}, 1)}
+	if err := db.Update(queue.recover); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return queue, nil
+}
+
+func (q *JobQueue) recover(tx *bolt.Tx) error {
+	for _, bucket := range [][]byte{jobsBucket, pendingBucket, runningBucket} {
+		if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+			return err
+		}
+	}
+
+	running := tx.Bucket(runningBucket)
+	interrupted := make([]uint64, 0)
+	if err := running.ForEach(func(path, id []byte) error {
+		interrupted = append(interrupted, binary.BigEndian.Uint64(id))
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	for _, id := range interrupted {
+		job, err := getJob(tx, id)
+		if err != nil {
+			return err
+		}
+
+		if err := running.Delete([]byte(job.Path)); err != nil {
+			return err
+		}
+
+		// The directory was queued again while it was running, that job will pick it up
+		if pending, err := pendingJob(tx, job.Path); err != nil {
+			return err
+		} else if pending != nil {
+			job.State = JOB_SKIPPED
+			job.Error = fmt.Sprintf("Interrupted, superseded by job %d", pending.ID)
+			if err := putJob(tx, job); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// Jobs keep their id so an interrupted job goes back to the front of the queue
+		fmt.Println("Resuming interrupted job", job.ID, job.Path)
+		job.State = JOB_PENDING
+		job.StartedAt = nil
+		if err := q.putPending(tx, job); err != nil {
+			return err
+		}
+	}
+
+	expired := time.Now().Add(-JOB_HISTORY)
+	jobs := tx.Bucket(jobsBucket)
+	stale := make([][]byte, 0)
+	if err := jobs.ForEach(func(key, value []byte) error {
+		var job Job
+		if err := json.Unmarshal(value, &job); err != nil {
+			return err
+		}
+
+		if job.Finished() && job.UpdatedAt.Before(expired) {
+			stale = append(stale, key)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	for _, key := range stale {
+		if err := jobs.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (q *JobQueue) Close() error {
+	return q.db.Close()
+}
+
+func (q *JobQueue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func getJob(tx *bolt.Tx, id uint64) (*Job, error) {
+	raw := tx.Bucket(jobsBucket).Get(jobKey(id))
+	if raw == nil {
+		return nil, ErrJobNotFound
+	}
+
+	var job Job
+	if err := json.Unmarshal(raw, &job); err != nil {
+		return nil, fmt.Errorf("Could not decode job %d: %v", id, err)
+	}
+	return &job, nil
+}
+
+func putJob(tx *bolt.Tx, job *Job) error {
+	job.UpdatedAt = time.Now()
+	raw, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(jobsBucket).Put(jobKey(job.ID), raw)
+}
+
+func (q *JobQueue) putPending(tx *bolt.Tx, job *Job) error {
+	if err := putJob(tx, job); err != nil {
+		return err
+	}
+	return tx.Bucket(pendingBucket).Put(jobKey(job.ID), []byte(job.Path))
+}
+
+func pendingJob(tx *bolt.Tx, path string) (*Job, error) {
+	cursor := tx.Bucket(pendingBucket).Cursor()
+	for id, pendingPath := cursor.First(); id != nil; id, pendingPath = cursor.Next() {
+		if string(pendingPath) == path {
+			return getJob(tx, binary.BigEndian.Uint64(id))
+		}
+	}
+	return nil, nil
+}
+
+// coveringJob finds the pending job for path or for a directory holding it, which processes path along the way.
+func coveringJob(tx *bolt.Tx, path string) (*Job, error) {
+	cursor := tx.Bucket(pendingBucket).Cursor()
+	for id, pendingPath := cursor.First(); id != nil; id, pendingPath = cursor.Next() {
+		if isWithin(string(pendingPath), path) {
+			return getJob(tx, binary.BigEndian.Uint64(id))
+		}
+	}
+	return nil, nil
+}
+
+// Enqueue adds a movie directory, returning the existing job when the directory, or one holding it, is already pending.
+func (q *JobQueue) Enqueue(library string, path string) (job *Job, err error) {
+	path = filepath.Clean(path)
+	err = q.db.Update(func(tx *bolt.Tx) error {
+		if job, err = coveringJob(tx, path); err != nil || job != nil {
+			return err
+		}
+
+		id, err := tx.Bucket(jobsBucket).NextSequence()
+		if err != nil {
+			return err
+		}
+
+		job = &Job{
+			ID:        id,
+			Library:   library,
+			Path:      path,
+			State:     JOB_PENDING,
+			CreatedAt: time.Now(),
+		}
+		return q.putPending(tx, job)
+	})
+
+	if err == nil {
+		q.signal()
+	}
+	return
+}
+
+// claim marks the oldest pending job whose directory does not overlap a running one as running.
+// A show and one of its seasons are never processed at once, both would transcode the same episodes.
+func (q *JobQueue) claim() (job *Job, err error) {
+	err = q.db.Update(func(tx *bolt.Tx) error {
+		running := tx.Bucket(runningBucket)
+		cursor := tx.Bucket(pendingBucket).Cursor()
+		for id, path := cursor.First(); id != nil; id, path = cursor.Next() {
+			if overlapsRunning(running, string(path)) {
+				continue
+			}
+
+			// Keys and values are only valid until the bucket is modified
+			id, path = append([]byte{}, id...), append([]byte{}, path...)
+			next, err := getJob(tx, binary.BigEndian.Uint64(id))
+			if err != nil {
+				return err
+			} else if err := cursor.Delete(); err != nil {
+				return err
+			} else if err := running.Put(path, id); err != nil {
+				return err
+			}
+
+			now := time.Now()
+			next.State = JOB_RUNNING
+			next.Attempts++
+			next.StartedAt = &now
+			next.FinishedAt = nil
+			next.Error = ""
+			job = next
+			return putJob(tx, job)
+		}
+		return nil
+	})
+	return
+}
+
+func overlapsRunning(running *bolt.Bucket, path string) bool {
+	cursor := running.Cursor()
+	for runningPath, _ := cursor.First(); runningPath != nil; runningPath, _ = cursor.Next() {
+		if pathsOverlap(string(runningPath), path) {
+			return true
+		}
+	}
+	return false
+}
+
+// Next blocks until a job can be claimed or ctx is cancelled.
+func (q *JobQueue) Next(ctx context.Context) (*Job, error) {
+	for {
+		job, err := q.claim()
+		if err != nil {
+			return nil, err
+		} else if job != nil {
+			// Pass the wake up along in case more jobs are waiting for other workers
+			q.signal()
+			return job, nil
+		}
+
+		select {
+		case <-q.wake:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Requeue returns a running job to the front of the queue, used when the daemon stops mid job.
+func (q *JobQueue) Requeue(job *Job) error {
+	err := q.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(runningBucket).Delete([]byte(job.Path)); err != nil {
+			return err
+		}
+
+		job.State = JOB_PENDING
+		job.StartedAt = nil
+		return q.putPending(tx, job)
+	})
+
+	q.signal()
+	return err
+}
+
+// Finish records the outcome of a running job.
+func (q *JobQueue) Finish(job *Job, state JobState, cause error) error {
+	err := q.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(runningBucket).Delete([]byte(job.Path)); err != nil {
+			return err
+		}
+
+		now := time.Now()
+		job.State = state
+		job.FinishedAt = &now
+		job.Error = ""
+		if cause != nil {
+			job.Error = cause.Error()
+		}
+		return putJob(tx, job)
+	})
+
+	q.signal()
+	return err
+}
+
+// Cancel skips a pending job so no worker picks it up.
+func (q *JobQueue) Cancel(id uint64) (job *Job, err error) {
+	err = q.db.Update(func(tx *bolt.Tx) error {
+		if job, err = getJob(tx, id); err != nil {
+			return err
+		} else if job.State != JOB_PENDING {
+			return ErrJobNotPending
+		}
+
+		if err := tx.Bucket(pendingBucket).Delete(jobKey(id)); err != nil {
+			return err
+		}
+
+		now := time.Now()
+		job.State = JOB_SKIPPED
+		job.FinishedAt = &now
+		job.Error = "Cancelled"
+		return putJob(tx, job)
+	})
+	return
+}
+
+func (q *JobQueue) Job(id uint64) (job *Job, err error) {
+	err = q.db.View(func(tx *bolt.Tx) error {
+		job, err = getJob(tx, id)
+		return err
+	})
+	return
+}
+
+// Jobs lists every known job in the order it was queued, optionally filtered by state.
+func (q *JobQueue) Jobs(states ...JobState) ([]*Job, error) {
+	jobs := make([]*Job, 0)
+	err := q.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(jobsBucket).ForEach(func(key, value []byte) error {
+			var job Job
+			if err := json.Unmarshal(value, &job); err != nil {
+				return err
+			}
+
+			for _, state := range states {
+				if job.State == state {
+					jobs = append(jobs, &job)
+					return nil
+				}
+			}
+
+			if len(states) == 0 {
+				jobs = append(jobs, &job)
+			}
+			return nil
+		})
+	})
+	return jobs, err
+}
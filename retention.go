@@ -0,0 +1,295 @@
+//By TimTheSinner
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+/**
+ * Copyright (c) 2016 TimTheSinner All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+const (
+	KEEP_FOREVER  = "forever"
+	KEEP_VERIFIED = "verified"
+	KEEP_WIDE     = "wide"
+)
+
+const DEFAULT_KEEP_WIDTH = 1920
+
+// RetentionPolicy decides when the -orig file left next to a transcode is discarded.
+//
+//	forever   never discard originals
+//	verified  discard originals Days after their transcode passed verification
+//	wide      only keep originals wider than MinWidth (1080p by default)
+//
+// Discarded originals are moved under Trash when it is set, otherwise they are deleted.
+type RetentionPolicy struct {
+	Keep     string `json:"keep,omitempty"`
+	Days     int    `json:"days,omitempty"`
+	MinWidth int    `json:"minWidth,omitempty"`
+	Trash    string `json:"trash,omitempty"`
+}
+
+func flagRetentionPolicy() *RetentionPolicy {
+	return &RetentionPolicy{
+		Keep:  *keepOriginals,
+		Days:  *keepDays,
+		Trash: *trashDir,
+	}
+}
+
+// inherit fills every unset field from defaults.
+func (p *RetentionPolicy) inherit(defaults *RetentionPolicy) {
+	if p.Keep == "" {
+		p.Keep = defaults.Keep
+	}
+	if p.Days == 0 {
+		p.Days = defaults.Days
+	}
+	if p.MinWidth == 0 {
+		p.MinWidth = defaults.MinWidth
+	}
+	if p.Trash == "" {
+		p.Trash = defaults.Trash
+	}
+}
+
+func (p *RetentionPolicy) Validate() error {
+	switch p.Keep {
+	case KEEP_FOREVER, KEEP_VERIFIED, KEEP_WIDE:
+	default:
+		return fmt.Errorf("Unknown retention %q, expected %s, %s or %s", p.Keep, KEEP_FOREVER, KEEP_VERIFIED, KEEP_WIDE)
+	}
+
+	if p.Days < 0 || p.MinWidth < 0 {
+		return fmt.Errorf("Retention values must not be negative")
+	}
+
+	if p.MinWidth == 0 {
+		p.MinWidth = DEFAULT_KEEP_WIDTH
+	}
+
+	if p.Trash != "" {
+		trash, err := filepath.Abs(p.Trash)
+		if err != nil {
+			return err
+		}
+		p.Trash = trash
+	}
+	return nil
+}
+
+// Discard reports whether the original recorded in meta has outlived the policy.
+func (p *RetentionPolicy) Discard(meta *Transcode, now time.Time) bool {
+	if !strings.HasSuffix(meta.OriginalMovie, "-orig") || meta.OriginalDiscarded != nil {
+		return false
+	}
+
+	switch p.Keep {
+	case KEEP_VERIFIED:
+		return meta.Verification != nil && now.Sub(meta.Verification.VerifiedAt) >= time.Duration(p.Days)*24*time.Hour
+	case KEEP_WIDE:
+		return meta.OriginalWidth <= p.MinWidth
+	}
+	return false
+}
+
+// discardOriginal removes or trashes the original of a transcode, returning the bytes freed in the library.
+func (p *RetentionPolicy) discardOriginal(library *Library, movieDir string, meta *Transcode, dryRun bool) (int64, error) {
+	original := filepath.Join(movieDir, meta.OriginalMovie)
+	info, err := os.Stat(original)
+	if err != nil {
+		return 0, err
+	}
+
+	if dryRun {
+		return info.Size(), nil
+	}
+
+	if p.Trash == "" {
+		if err := os.Remove(original); err != nil {
+			return 0, err
+		}
+	} else {
+		rel, err := filepath.Rel(library.Path, movieDir)
+		if err != nil {
+			return 0, err
+		}
+
+		trashed := filepath.Join(p.Trash, filepath.Base(library.Path), rel, meta.OriginalMovie)
+		if err := os.MkdirAll(filepath.Dir(trashed), 0755); err != nil {
+			return 0, err
+		}
+		if err := moveFile(original, trashed); err != nil {
+			return 0, err
+		}
+		meta.OriginalTrash = trashed
+	}
+
+	now := time.Now()
+	meta.OriginalDiscarded = &now
+	return info.Size(), nil
+}
+
+// moveFile renames when it can and copies across filesystems when it cannot.
+func moveFile(source, target string) error {
+	if err := os.Rename(source, target); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(target)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(target)
+		return err
+	}
+	return os.Remove(source)
+}
+
+// applyRetention discards the original of one movie if the library policy allows it.
+func applyRetention(library *Library, movieDir string, meta *Transcode) {
+	if !library.Retention.Discard(meta, time.Now()) {
+		return
+	}
+
+	freed, err := library.Retention.discardOriginal(library, movieDir, meta, false)
+	if err != nil {
+		fmt.Println("Could not discard", meta.OriginalMovie, err)
+		return
+	}
+	fmt.Printf("Discarded %s, reclaimed %s\n", meta.OriginalMovie, formatBytes(freed))
+}
+
+// cleanup applies the retention policy across every library and reports the space reclaimed.
+func cleanup(config *Config, dryRun bool) error {
+	out := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(out, "MOVIE\tORIGINAL\tSIZE\tACTION")
+
+	var total int64
+	for _, library := range config.Libraries {
+		action := "deleted"
+		if library.Retention.Trash != "" {
+			action = "trashed"
+		}
+		if dryRun {
+			action = "would be " + action
+		}
+
+		transcodes, err := library.store.Query(MetadataQuery{Status: STATUS_TRANSCODED})
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		for _, meta := range transcodes {
+			movieName := meta.Movie
+			if !library.Retention.Discard(meta, now) {
+				continue
+			}
+
+			movieDir := transcodeDir(library.Path, meta)
+			lock, err := NewLockfile(filepath.Join(movieDir, "transcoding.lck"))
+			if err != nil {
+				fmt.Fprintf(out, "%s\t%s\t-\tskipped: %v\n", movieName, meta.OriginalMovie, err)
+				continue
+			}
+
+			// A worker may have rewritten the record since it was queried, decide again on what is there now
+			current, ok, err := library.store.Get(movieName)
+			if err != nil {
+				fmt.Fprintf(out, "%s\t%s\t-\tskipped: %v\n", movieName, meta.OriginalMovie, err)
+				lock.Unlock()
+				continue
+			} else if !ok || !library.Retention.Discard(current, now) {
+				lock.Unlock()
+				continue
+			}
+			meta = current
+
+			freed, err := library.Retention.discardOriginal(library, movieDir, meta, dryRun)
+			if os.IsNotExist(err) {
+				// Removed by hand, only the metadata needs to catch up
+				now := time.Now()
+				meta.OriginalDiscarded = &now
+			} else if err != nil {
+				fmt.Fprintf(out, "%s\t%s\t-\tfailed: %v\n", movieName, meta.OriginalMovie, err)
+				lock.Unlock()
+				continue
+			} else {
+				total += freed
+				fmt.Fprintf(out, "%s\t%s\t%s\t%s\n", movieName, meta.OriginalMovie, formatBytes(freed), action)
+			}
+
+			if !dryRun {
+				// Only the discard is recorded, anything else written meanwhile is kept
+				err := library.store.Update(movieName, func(current *Transcode) (*Transcode, error) {
+					if current == nil {
+						return nil, fmt.Errorf("Record was removed")
+					}
+					current.OriginalDiscarded = meta.OriginalDiscarded
+					current.OriginalTrash = meta.OriginalTrash
+					return current, nil
+				})
+				if err != nil {
+					fmt.Fprintf(out, "%s\t%s\t-\tnot recorded: %v\n", movieName, meta.OriginalMovie, err)
+				}
+			}
+			lock.Unlock()
+		}
+	}
+	out.Flush()
+
+	if dryRun {
+		fmt.Println("Would reclaim", formatBytes(total))
+	} else {
+		fmt.Println("Reclaimed", formatBytes(total))
+	}
+	return nil
+}
+
+func formatBytes(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
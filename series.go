@@ -0,0 +1,188 @@
+//By TimTheSinner
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+/**
+ * Copyright (c) 2016 TimTheSinner All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+var (
+	// S01E02, s1e2, S01E01E02 and S01E01-E03
+	seasonEpisodeRegex = regexp.MustCompile(`(?i)(?:^|[^a-z0-9])s(?P<season>\d{1,2})[ ._-]?e(?P<episode>\d{1,3})(?:-?e|-)?(?P<last>\d{1,3})?(?:[^0-9]|$)`)
+	// 1x02 and 01x02-03
+	crossEpisodeRegex = regexp.MustCompile(`(?i)(?:^|[^a-z0-9])(?P<season>\d{1,2})x(?P<episode>\d{2,3})(?:-(?P<last>\d{2,3}))?(?:[^0-9]|$)`)
+	// Episode 2, Ep02 or E02 inside a season directory
+	bareEpisodeRegex = regexp.MustCompile(`(?i)(?:^|[^a-z0-9])(?:episode|ep|e)[ ._-]?(?P<episode>\d{1,3})(?:[^0-9]|$)`)
+	// Season 1, Season.01, S01 and Specials
+	seasonDirRegex = regexp.MustCompile(`(?i)^(?:season[ ._-]*(?P<season>\d{1,2})|s(?P<season2>\d{1,2})|(?P<specials>specials?))$`)
+)
+
+// Episode locates a file within a TV series, LastEpisode is set for files holding several episodes.
+type Episode struct {
+	Series      string `json:"series"`
+	Season      int    `json:"season"`
+	Episode     int    `json:"episode"`
+	LastEpisode int    `json:"lastEpisode,omitempty"`
+}
+
+func (e *Episode) String() string {
+	code := fmt.Sprintf("S%02dE%02d", e.Season, e.Episode)
+	if e.LastEpisode > e.Episode {
+		code += fmt.Sprintf("-E%02d", e.LastEpisode)
+	}
+	if e.Series == "" {
+		return code
+	}
+	return e.Series + " " + code
+}
+
+func atoi(value string) int {
+	number, _ := strconv.Atoi(value)
+	return number
+}
+
+// seasonDirectory recognises directories like "Season 01", returning the season number, 0 for specials.
+func seasonDirectory(name string) (int, bool) {
+	groups := groupsFromRegex(seasonDirRegex, strings.TrimSpace(name))
+	switch {
+	case groups == nil:
+		return 0, false
+	case groups["specials"] != "":
+		return 0, true
+	case groups["season"] != "":
+		return atoi(groups["season"]), true
+	}
+	return atoi(groups["season2"]), true
+}
+
+// parseEpisode reads the series, season and episode from a media path relative to its library,
+// like "Show/Season 01/Show.S01E02.mkv", "Show/S01E02.mkv" or "Show/Season 2/Episode 3.mkv".
+func parseEpisode(relPath string) (*Episode, bool) {
+	parts := strings.Split(filepath.ToSlash(relPath), "/")
+	name := strings.TrimSuffix(parts[len(parts)-1], filepath.Ext(parts[len(parts)-1]))
+	dirs := parts[:len(parts)-1]
+
+	episode := &Episode{}
+	if groups := groupsFromRegex(seasonEpisodeRegex, name); groups != nil {
+		episode.Season, episode.Episode, episode.LastEpisode = atoi(groups["season"]), atoi(groups["episode"]), atoi(groups["last"])
+	} else if groups := groupsFromRegex(crossEpisodeRegex, name); groups != nil {
+		episode.Season, episode.Episode, episode.LastEpisode = atoi(groups["season"]), atoi(groups["episode"]), atoi(groups["last"])
+	} else if len(dirs) == 0 {
+		return nil, false
+	} else if season, ok := seasonDirectory(dirs[len(dirs)-1]); !ok {
+		return nil, false
+	} else if groups := groupsFromRegex(bareEpisodeRegex, name); groups != nil {
+		episode.Season, episode.Episode = season, atoi(groups["episode"])
+	} else {
+		return nil, false
+	}
+
+	if episode.LastEpisode <= episode.Episode {
+		episode.LastEpisode = 0
+	}
+
+	// The series is the directory above any season directory
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if _, ok := seasonDirectory(dirs[i]); !ok {
+			episode.Series = dirs[i]
+			break
+		}
+	}
+	return episode, true
+}
+
+// mediaTitle names the video stream after the episode when the path describes one, otherwise after the movie directory.
+func mediaTitle(file string) string {
+	// The series and season directories are all parseEpisode needs
+	parts := strings.Split(filepath.ToSlash(file), "/")
+	if len(parts) > 3 {
+		parts = parts[len(parts)-3:]
+	}
+
+	if episode, ok := parseEpisode(strings.Join(parts, "/")); ok {
+		return episode.String()
+	}
+	return filepath.Base(filepath.Dir(file))
+}
+
+// mediaKey identifies a media file in its library's metadata, it is the path relative to the library
+// without the extension so it survives the container changing when the file is transcoded.
+func mediaKey(libraryPath, file string) (string, error) {
+	rel, err := filepath.Rel(libraryPath, file)
+	if err != nil {
+		return "", err
+	}
+	return filepath.ToSlash(strings.TrimSuffix(rel, filepath.Ext(rel))), nil
+}
+
+// keyEpisode parses the episode of file from its media key, putting back the extension parseEpisode expects
+// so a tag like S01E02 is not mistaken for one.
+func keyEpisode(key, file string) *Episode {
+	episode, _ := parseEpisode(key + filepath.Ext(file))
+	return episode
+}
+
+// legacyMediaKey is the movie directory name metadata was keyed by before files were tracked individually,
+// only files directly inside a top level directory can have one.
+func legacyMediaKey(key string) (string, bool) {
+	parts := strings.Split(key, "/")
+	if len(parts) != 2 {
+		return "", false
+	}
+	return parts[0], true
+}
+
+// transcodeDir is the directory holding the media a metadata entry describes.
+func transcodeDir(libraryPath string, meta *Transcode) string {
+	if !strings.Contains(meta.Movie, "/") {
+		// Keyed by the movie directory itself
+		return filepath.Join(libraryPath, meta.Movie)
+	}
+	return filepath.Join(libraryPath, filepath.FromSlash(filepath.Dir(meta.Movie)))
+}
+
+// mediaFiles walks dir for media that should be transcoded, skipping our own working files.
+func mediaFiles(dir string) ([]string, error) {
+	files := make([]string, 0)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		name := info.Name()
+		if info.IsDir() {
+			if path != dir && strings.HasPrefix(name, ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if process, ok := PROCESS_FILE_EXTENSIONS[filepath.Ext(name)]; !ok {
+			fmt.Printf("UNKNOWN FILE TYPE %s in %s\n", filepath.Ext(name), filepath.Dir(path))
+		} else if process && !strings.HasPrefix(name, "transcode-") && info.Size() > MIN_FILE_SIZE {
+			files = append(files, path)
+		}
+		return nil
+	})
+	return files, err
+}
@@ -0,0 +1,51 @@
+//By TimTheSinner
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+/**
+ * Copyright (c) 2016 TimTheSinner All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+func TestKeyEpisode(t *testing.T) {
+	library := filepath.FromSlash("/media/tv")
+	tests := []struct {
+		file     string
+		expected *Episode
+	}{
+		{"Show/Season 1/Show.S01E02.mkv", &Episode{Series: "Show", Season: 1, Episode: 2}},
+		{"Show/Show.S02E03E04.mp4", &Episode{Series: "Show", Season: 2, Episode: 3, LastEpisode: 4}},
+		{"Show/Season 2/Episode 5.ts", &Episode{Series: "Show", Season: 2, Episode: 5}},
+		{"Movie/Movie.mkv", nil},
+	}
+
+	for _, test := range tests {
+		file := filepath.Join(library, filepath.FromSlash(test.file))
+		key, err := mediaKey(library, file)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		episode := keyEpisode(key, file)
+		if test.expected == nil && episode != nil {
+			t.Errorf("Expected %s not to be an episode, got %+v", test.file, episode)
+		} else if test.expected != nil && (episode == nil || *episode != *test.expected) {
+			t.Errorf("Expected %s to be %+v, got %+v", test.file, test.expected, episode)
+		}
+	}
+}
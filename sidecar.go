@@ -0,0 +1,161 @@
+//By TimTheSinner
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+/**
+ * Copyright (c) 2016 TimTheSinner All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Subtitle files muxed from beside a movie by the codec ffmpeg reads them as, a VobSub .sub is read through its .idx
+var SIDECAR_SUBTITLE_CODECS = map[string]string{
+	".srt": "subrip",
+	".ass": "ass",
+	".ssa": "ass",
+	".vtt": "webvtt",
+	".idx": "dvd_subtitle",
+}
+
+// Filename tags marking subtitles for the deaf and hard of hearing
+var SDH_TAGS = map[string]bool{"sdh": true, "cc": true, "hi": true}
+
+// Sidecar is a subtitle file next to a movie, described as the stream ffmpeg will read from it.
+type Sidecar struct {
+	File   string
+	Stream *Stream
+}
+
+// findSidecars lists the subtitle files named after movie, like Movie.en.srt or Movie.eng.forced.srt.
+func findSidecars(movie string) ([]*Sidecar, error) {
+	files, err := ioutil.ReadDir(filepath.Dir(movie))
+	if err != nil {
+		return nil, err
+	}
+
+	stem := strings.TrimSuffix(filepath.Base(movie), filepath.Ext(movie))
+	sidecars := make([]*Sidecar, 0)
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		} else if stream, ok := parseSidecar(stem, file.Name()); ok {
+			sidecars = append(sidecars, &Sidecar{filepath.Join(filepath.Dir(movie), file.Name()), stream})
+		}
+	}
+	return sidecars, nil
+}
+
+// parseSidecar reads the language and forced or SDH flags from the dotted tags between the movie name and the extension.
+func parseSidecar(stem, name string) (*Stream, bool) {
+	ext := strings.ToLower(filepath.Ext(name))
+	codec, ok := SIDECAR_SUBTITLE_CODECS[ext]
+	if !ok || !strings.HasPrefix(name, stem) {
+		return nil, false
+	}
+
+	tags := strings.TrimSuffix(strings.TrimPrefix(name, stem), filepath.Ext(name))
+	if tags != "" && !strings.HasPrefix(tags, ".") {
+		// Movie 2.srt belongs to a different movie
+		return nil, false
+	}
+
+	stream := &Stream{CodecName: codec, CodecType: "subtitle"}
+	for _, tag := range strings.Split(strings.ToLower(tags), ".") {
+		if tag == "" {
+			continue
+		} else if tag == "forced" {
+			stream.Disposition.Forced = 1
+		} else if SDH_TAGS[tag] {
+			stream.Disposition.HearingImpaired = 1
+		} else if isLanguage(tag) {
+			stream.Tags.Language = normalizeLanguage(tag)
+		} else if _, err := strconv.Atoi(tag); err != nil {
+			// Movie.Part2.en.srt or Movie.Extended.en.srt belong to a different movie, track numbers are all we skip
+			return nil, false
+		}
+	}
+	return stream, true
+}
+
+// selectSidecars applies the subtitle languages to sidecars, assigning each kept one the ffmpeg input after firstInput.
+// Sidecars without a language are taken to be in fallback, usually the primary audio language.
+func (p LanguagePolicy) selectSidecars(sidecars []*Sidecar, fallback string, firstInput int) (selected []*SelectedStream, inputs []string) {
+	files := make(map[*Stream]string)
+	streams := make([]*Stream, 0, len(sidecars))
+	for _, sidecar := range sidecars {
+		if sidecar.Stream.Tags.Language == "" {
+			sidecar.Stream.Tags.Language = fallback
+		}
+		files[sidecar.Stream] = sidecar.File
+		streams = append(streams, sidecar.Stream)
+	}
+
+	selected = selectLanguages(streams, p.Subtitles, p.KeepUndetermined)
+	for i, stream := range selected {
+		// Subtitle files carry no language of their own
+		stream.Input, stream.Inferred = firstInput+i, stream.Language != ""
+		inputs = append(inputs, files[stream.Stream])
+	}
+	return selected, inputs
+}
+
+func textSidecars(sidecars []*Sidecar) []*Sidecar {
+	text := make([]*Sidecar, 0, len(sidecars))
+	for _, sidecar := range sidecars {
+		if sidecar.Stream.CodecName != "dvd_subtitle" {
+			text = append(text, sidecar)
+		}
+	}
+	return text
+}
+
+func sidecarNames(files []string) []string {
+	names := make([]string, 0, len(files))
+	for _, file := range files {
+		names = append(names, filepath.Base(file))
+	}
+	return names
+}
+
+// sidecarTitle names forced and SDH sidecars so players can tell them from the full subtitles.
+func sidecarTitle(stream *Stream) string {
+	titles := make([]string, 0, 2)
+	if stream.Disposition.Forced != 0 {
+		titles = append(titles, "Forced")
+	}
+	if stream.Disposition.HearingImpaired != 0 {
+		titles = append(titles, "SDH")
+	}
+	return strings.Join(titles, " ")
+}
+
+// sidecarDisposition flags a sidecar, every flag ffmpeg would otherwise guess is cleared.
+func sidecarDisposition(stream *Stream) string {
+	flags := make([]string, 0, 2)
+	if stream.Disposition.Forced != 0 {
+		flags = append(flags, "forced")
+	}
+	if stream.Disposition.HearingImpaired != 0 {
+		flags = append(flags, "hearing_impaired")
+	}
+	if len(flags) == 0 {
+		return "0"
+	}
+	return strings.Join(flags, "+")
+}
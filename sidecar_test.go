@@ -0,0 +1,84 @@
+//By TimTheSinner
+package main
+
+import (
+	"testing"
+)
+
+/**
+ * Copyright (c) 2016 TimTheSinner All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+func TestParseSidecar(t *testing.T) {
+	tests := []struct {
+		name     string
+		ok       bool
+		codec    string
+		language string
+		forced   bool
+		sdh      bool
+	}{
+		{"Movie.srt", true, "subrip", "", false, false},
+		{"Movie.en.srt", true, "subrip", "eng", false, false},
+		{"Movie.forced.srt", true, "subrip", "", true, false},
+		{"Movie.eng.forced.srt", true, "subrip", "eng", true, false},
+		{"Movie.English.SDH.srt", true, "subrip", "eng", false, true},
+		{"Movie.fr.hi.forced.ass", true, "ass", "fre", true, true},
+		{"Movie.de.vtt", true, "webvtt", "ger", false, false},
+		{"Movie.idx", true, "dvd_subtitle", "", false, false},
+		{"Movie.1.spa.SRT", true, "subrip", "spa", false, false},
+		{"Movie.sub", false, "", "", false, false},
+		{"Movie.nfo", false, "", "", false, false},
+		{"Movie 2.en.srt", false, "", "", false, false},
+		{"Other.en.srt", false, "", "", false, false},
+		{"Movie.tur.srt", true, "subrip", "tur", false, false},
+		{"Movie.heb.srt", true, "subrip", "heb", false, false},
+		{"Movie.pt-BR.srt", true, "subrip", "por", false, false},
+		{"Movie.en-US.forced.srt", true, "subrip", "eng", true, false},
+		{"Movie.sr_Latn.srt", true, "subrip", "srp", false, false},
+		{"Movie.he.srt", true, "subrip", "heb", false, false},
+		{"Movie.Part2.en.srt", false, "", "", false, false},
+		{"Movie.Extended.en.srt", false, "", "", false, false},
+		{"Movie.Extended.srt", false, "", "", false, false},
+	}
+
+	for _, test := range tests {
+		stream, ok := parseSidecar("Movie", test.name)
+		if ok != test.ok {
+			t.Errorf("%s: expected ok=%t", test.name, test.ok)
+			continue
+		} else if !ok {
+			continue
+		}
+
+		if stream.CodecName != test.codec || stream.Tags.Language != test.language ||
+			(stream.Disposition.Forced != 0) != test.forced || (stream.Disposition.HearingImpaired != 0) != test.sdh {
+			t.Errorf("%s: unexpected stream %+v", test.name, stream)
+		}
+	}
+}
+
+func TestSidecarLanguagesOutsideTheNameTable(t *testing.T) {
+	sidecars := make([]*Sidecar, 0)
+	for _, name := range []string{"Movie.tur.srt", "Movie.pt-BR.srt", "Movie.heb.srt"} {
+		stream, _ := parseSidecar("Movie", name)
+		sidecars = append(sidecars, &Sidecar{name, stream})
+	}
+
+	selected, inputs := LanguagePolicy{Subtitles: []string{"tr", "pt"}}.selectSidecars(sidecars, "eng", 1)
+	if len(selected) != 2 || inputs[0] != "Movie.tur.srt" || inputs[1] != "Movie.pt-BR.srt" {
+		t.Errorf("Expected the turkish and portuguese sidecars, got %v", inputs)
+	}
+}
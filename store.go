@@ -0,0 +1,425 @@
+//By TimTheSinner
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+/**
+ * Copyright (c) 2016 TimTheSinner All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+const (
+	STORE_JSON = "json"
+	STORE_BOLT = "bolt"
+
+	METADATA_DB = "transcode-metadata.db"
+)
+
+const (
+	STATUS_TRANSCODED = "transcoded"
+	STATUS_FAILED     = "failed"
+)
+
+var bucketTranscodes = []byte("transcodes")
+
+var ErrMetadataInUse = errors.New("Metadata database is locked by another process")
+
+// MetadataQuery filters transcode records, zero values match everything.
+type MetadataQuery struct {
+	Status string
+	Series string
+	// Codec matches either the original or the transcoded video codec
+	Codec string
+	Since time.Time
+	Until time.Time
+}
+
+func (q MetadataQuery) Matches(meta *Transcode) bool {
+	if q.Status != "" && meta.Status() != q.Status {
+		return false
+	}
+	if q.Series != "" && (meta.Episode == nil || !strings.EqualFold(meta.Episode.Series, q.Series)) {
+		return false
+	}
+	if q.Codec != "" && !strings.EqualFold(meta.OriginalCodec, q.Codec) && !strings.EqualFold(meta.TranscodedCodec, q.Codec) {
+		return false
+	}
+	if !q.Since.IsZero() && meta.UpdatedAt.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !meta.UpdatedAt.Before(q.Until) {
+		return false
+	}
+	return true
+}
+
+// MetadataStore records the transcode history of one library, keyed by movie.
+type MetadataStore interface {
+	Get(movie string) (*Transcode, bool, error)
+	Put(meta *Transcode) error
+	// Update atomically replaces the record of movie with the result of update, nil deletes it
+	Update(movie string, update func(meta *Transcode) (*Transcode, error)) error
+	// Query returns the matching records ordered by movie
+	Query(query MetadataQuery) ([]*Transcode, error)
+	Close() error
+}
+
+func openMetadataStore(kind, mediaDir string) (MetadataStore, error) {
+	switch kind {
+	case STORE_JSON:
+		return &JSONMetadataStore{mediaDir}, nil
+	case STORE_BOLT:
+		return OpenBoltMetadataStore(filepath.Join(mediaDir, METADATA_DB))
+	}
+	return nil, fmt.Errorf("Unknown metadata store %q, expected %s or %s", kind, STORE_JSON, STORE_BOLT)
+}
+
+// openMetadataStores opens the configured store of every library, closing them all again on failure.
+func openMetadataStores(config *Config) error {
+	for i, library := range config.Libraries {
+		store, err := openMetadataStore(config.MetadataStore, library.Path)
+		if err != nil {
+			closeMetadataStores(config.Libraries[:i])
+			return fmt.Errorf("Library %s: %v", library.Path, err)
+		}
+		library.store = store
+	}
+	return nil
+}
+
+func closeMetadataStores(libraries []*Library) {
+	for _, library := range libraries {
+		if library.store != nil {
+			if err := library.store.Close(); err != nil {
+				fmt.Println("Could not close metadata of", library.Path, err)
+			}
+			library.store = nil
+		}
+	}
+}
+
+// clearFailure forgets the failure history of a movie so it is attempted again, movies that never transcoded are dropped entirely.
+func clearFailure(store MetadataStore, movie string) error {
+	return store.Update(movie, func(meta *Transcode) (*Transcode, error) {
+		if meta == nil || meta.Failure == nil {
+			return meta, nil
+		} else if meta.TranscodedMovie == "" {
+			return nil, nil
+		}
+
+		meta.Failure = nil
+		return meta, nil
+	})
+}
+
+// lookupTranscode finds the metadata of a media file, falling back to the entry of its movie directory
+// when it was recorded before files were tracked individually. legacyKey is set when that entry was used.
+func lookupTranscode(store MetadataStore, key, fileName string) (meta *Transcode, legacyKey string, err error) {
+	meta, ok, err := store.Get(key)
+	if err != nil || ok {
+		return meta, "", err
+	}
+
+	legacyKey, ok = legacyMediaKey(key)
+	if !ok {
+		return nil, "", nil
+	}
+
+	meta, ok, err = store.Get(legacyKey)
+	if err != nil || !ok {
+		return nil, "", err
+	}
+
+	// The directory entry only describes this file if it names it, other files in the directory start fresh
+	stem := func(name string) string { return strings.TrimSuffix(name, filepath.Ext(name)) }
+	if stem(meta.TranscodedMovie) != stem(fileName) && strings.TrimSuffix(meta.OriginalMovie, "-orig") != fileName {
+		return nil, "", nil
+	}
+	return meta, legacyKey, nil
+}
+
+// putTranscode records meta under its own key, dropping the directory entry it was migrated from.
+func putTranscode(store MetadataStore, meta *Transcode, legacyKey string) error {
+	if err := store.Put(meta); err != nil {
+		return err
+	}
+
+	if legacyKey != "" {
+		return store.Update(legacyKey, func(*Transcode) (*Transcode, error) {
+			return nil, nil
+		})
+	}
+	return nil
+}
+
+func sortTranscodes(transcodes []*Transcode) []*Transcode {
+	sort.Slice(transcodes, func(i, j int) bool { return transcodes[i].Movie < transcodes[j].Movie })
+	return transcodes
+}
+
+// JSONMetadataStore is the transcode-metadata.json file in the library root.
+type JSONMetadataStore struct {
+	mediaDir string
+}
+
+func (s *JSONMetadataStore) Get(movie string) (*Transcode, bool, error) {
+	mediaMetadata, err := readMetadata(s.mediaDir)
+	if err != nil {
+		return nil, false, err
+	}
+	meta, ok := mediaMetadata[movie]
+	return meta, ok, nil
+}
+
+func (s *JSONMetadataStore) Put(meta *Transcode) error {
+	return writeMetadata(s.mediaDir, meta)
+}
+
+func (s *JSONMetadataStore) Update(movie string, update func(meta *Transcode) (*Transcode, error)) error {
+	return updateMetadata(s.mediaDir, func(mediaMetadata map[string]*Transcode) error {
+		meta, err := update(mediaMetadata[movie])
+		if err != nil {
+			return err
+		} else if meta == nil {
+			delete(mediaMetadata, movie)
+		} else {
+			mediaMetadata[movie] = meta
+		}
+		return nil
+	})
+}
+
+func (s *JSONMetadataStore) Query(query MetadataQuery) ([]*Transcode, error) {
+	mediaMetadata, err := readMetadata(s.mediaDir)
+	if err != nil {
+		return nil, err
+	}
+
+	transcodes := make([]*Transcode, 0)
+	for movie, meta := range mediaMetadata {
+		// Entries written before Movie was recorded are only keyed by it
+		meta.Movie = movie
+		if query.Matches(meta) {
+			transcodes = append(transcodes, meta)
+		}
+	}
+	return sortTranscodes(transcodes), nil
+}
+
+func (s *JSONMetadataStore) Close() error {
+	return nil
+}
+
+// BoltMetadataStore keeps one JSON encoded record per movie in an embedded database,
+// so completing a job only writes that movie instead of the whole library.
+// The database is only open for the length of each call, cleanup and migrate share it with a running daemon.
+type BoltMetadataStore struct {
+	file string
+	// Serialises the calls of this process, bolt's file lock would leave them polling for each other
+	lock sync.Mutex
+}
+
+func OpenBoltMetadataStore(file string) (*BoltMetadataStore, error) {
+	store := &BoltMetadataStore{file: file}
+	err := store.update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucketTranscodes)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// open waits up to METADATA_LOCK_TIMEOUT for another process to finish with the database.
+func (s *BoltMetadataStore) open(readOnly bool) (*bolt.DB, error) {
+	db, err := bolt.Open(s.file, 0644, &bolt.Options{Timeout: METADATA_LOCK_TIMEOUT, ReadOnly: readOnly})
+	if err == bolt.ErrTimeout {
+		return nil, ErrMetadataInUse
+	}
+	return db, err
+}
+
+func (s *BoltMetadataStore) view(fn func(tx *bolt.Tx) error) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	db, err := s.open(true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.View(fn)
+}
+
+func (s *BoltMetadataStore) update(fn func(tx *bolt.Tx) error) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	db, err := s.open(false)
+	if err != nil {
+		return err
+	}
+
+	if err := db.Update(fn); err != nil {
+		db.Close()
+		return err
+	}
+	return db.Close()
+}
+
+func decodeTranscode(raw []byte) (*Transcode, error) {
+	meta := &Transcode{}
+	if err := json.Unmarshal(raw, meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+func (s *BoltMetadataStore) Get(movie string) (meta *Transcode, ok bool, err error) {
+	err = s.view(func(tx *bolt.Tx) error {
+		raw := tx.Bucket(bucketTranscodes).Get([]byte(movie))
+		if raw == nil {
+			return nil
+		}
+
+		ok = true
+		meta, err = decodeTranscode(raw)
+		return err
+	})
+	return
+}
+
+func (s *BoltMetadataStore) Put(meta *Transcode) error {
+	return s.Update(meta.Movie, func(*Transcode) (*Transcode, error) {
+		return meta, nil
+	})
+}
+
+func (s *BoltMetadataStore) Update(movie string, update func(meta *Transcode) (*Transcode, error)) error {
+	return s.update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketTranscodes)
+
+		var current *Transcode
+		if raw := bucket.Get([]byte(movie)); raw != nil {
+			var err error
+			if current, err = decodeTranscode(raw); err != nil {
+				return err
+			}
+		}
+
+		meta, err := update(current)
+		if err != nil {
+			return err
+		} else if meta == nil {
+			return bucket.Delete([]byte(movie))
+		}
+
+		meta.Movie = movie
+		raw, err := json.Marshal(meta)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(movie), raw)
+	})
+}
+
+func (s *BoltMetadataStore) Query(query MetadataQuery) ([]*Transcode, error) {
+	transcodes := make([]*Transcode, 0)
+	err := s.view(func(tx *bolt.Tx) error {
+		// Keys are movie names so the cursor already walks them in order
+		return tx.Bucket(bucketTranscodes).ForEach(func(_, raw []byte) error {
+			meta, err := decodeTranscode(raw)
+			if err != nil {
+				return err
+			}
+			if query.Matches(meta) {
+				transcodes = append(transcodes, meta)
+			}
+			return nil
+		})
+	})
+	return transcodes, err
+}
+
+func (s *BoltMetadataStore) Close() error {
+	return nil
+}
+
+// migrate imports the transcode-metadata.json of every library into its embedded database.
+// Records already in the database are kept, it is safe to run more than once.
+func migrate(config *Config) error {
+	for _, library := range config.Libraries {
+		file := filepath.Join(library.Path, METADATA_FILE)
+		info, err := os.Stat(file)
+		if os.IsNotExist(err) {
+			fmt.Println("Nothing to migrate in", library.Path)
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		transcodes, err := (&JSONMetadataStore{library.Path}).Query(MetadataQuery{})
+		if err != nil {
+			return err
+		}
+
+		store, err := OpenBoltMetadataStore(filepath.Join(library.Path, METADATA_DB))
+		if err != nil {
+			return fmt.Errorf("Library %s: %v", library.Path, err)
+		}
+
+		imported := 0
+		for _, meta := range transcodes {
+			if meta.UpdatedAt.IsZero() {
+				// Older records carry no date, the file was last written no earlier than they were
+				meta.UpdatedAt = info.ModTime()
+			}
+
+			err := store.Update(meta.Movie, func(current *Transcode) (*Transcode, error) {
+				if current != nil {
+					return current, nil
+				}
+				imported++
+				return meta, nil
+			})
+			if err != nil {
+				store.Close()
+				return err
+			}
+		}
+
+		if err := store.Close(); err != nil {
+			return err
+		}
+		fmt.Printf("Imported %d of %d records from %s\n", imported, len(transcodes), file)
+	}
+
+	if config.MetadataStore != STORE_BOLT {
+		fmt.Println("Run with -metadata-store", STORE_BOLT, "or set \"metadataStore\": \""+STORE_BOLT+"\" to use the imported records")
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+//By TimTheSinner
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+/**
+ * Copyright (c) 2016 TimTheSinner All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+func TestBoltStoreIsSharedWithCommands(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transcoder-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, METADATA_DB)
+	daemon, err := OpenBoltMetadataStore(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer daemon.Close()
+	if err := daemon.Put(&Transcode{Movie: "Movie/Movie", OriginalMovie: "Movie.mkv-orig"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Cleanup opens the same database while the daemon still has its store
+	command, err := OpenBoltMetadataStore(file)
+	if err != nil {
+		t.Fatalf("Expected the database to be shared, got %v", err)
+	}
+	defer command.Close()
+
+	err = command.Update("Movie/Movie", func(meta *Transcode) (*Transcode, error) {
+		meta.OriginalTrash = "trash/Movie.mkv-orig"
+		return meta, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if meta, ok, err := daemon.Get("Movie/Movie"); err != nil || !ok || meta.OriginalTrash != "trash/Movie.mkv-orig" {
+		t.Errorf("Expected the daemon to read the command's write, got %+v %v", meta, err)
+	}
+}
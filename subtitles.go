@@ -0,0 +1,143 @@
+//By TimTheSinner
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+/**
+ * Copyright (c) 2016 TimTheSinner All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Subtitle codecs that can be written out as srt, bitmap formats like PGS and VobSub would need OCR
+var TEXT_SUBTITLE_CODECS = map[string]bool{
+	"subrip":   true,
+	"srt":      true,
+	"ass":      true,
+	"ssa":      true,
+	"mov_text": true,
+	"webvtt":   true,
+	"text":     true,
+}
+
+// ExtractedSubtitle records an embedded subtitle written out as a sidecar, or why it could not be.
+type ExtractedSubtitle struct {
+	Stream   int    `json:"stream"`
+	Codec    string `json:"codec"`
+	Language string `json:"language,omitempty"`
+	Forced   bool   `json:"forced,omitempty"`
+	File     string `json:"file,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// subtitleSidecarName names an extracted subtitle like Movie.eng.forced.srt, numbering it when the name is taken.
+func subtitleSidecarName(movie string, stream *SelectedStream, taken map[string]bool) string {
+	language := stream.Language
+	if language == "" {
+		language = "und"
+	}
+
+	stem := strings.TrimSuffix(filepath.Base(movie), filepath.Ext(movie)) + "." + language
+	if stream.Disposition.Forced != 0 {
+		stem += ".forced"
+	}
+	if stream.Disposition.HearingImpaired != 0 {
+		stem += ".sdh"
+	}
+
+	name := stem + ".srt"
+	for i := 2; taken[name]; i++ {
+		name = stem + "." + strconv.Itoa(i) + ".srt"
+	}
+	taken[name] = true
+	return name
+}
+
+// extractSubtitles writes every kept embedded text subtitle of original to an srt beside movie in a single pass.
+// Bitmap subtitles are recorded as not extractable, a failed extraction is recorded against each subtitle it covered.
+func extractSubtitles(ctx context.Context, executor Executor, worker *Worker, original, movie string, subtitles []*SelectedStream) ([]*ExtractedSubtitle, error) {
+	dir := filepath.Dir(movie)
+	taken := make(map[string]bool)
+	if files, err := ioutil.ReadDir(dir); err == nil {
+		for _, file := range files {
+			taken[file.Name()] = true
+		}
+	}
+
+	extracted := make([]*ExtractedSubtitle, 0, len(subtitles))
+	pending := make([]*ExtractedSubtitle, 0, len(subtitles))
+	args := []string{"-nostdin", "-hide_banner", "-nostats", "-y", "-i", original}
+	for _, stream := range subtitles {
+		if stream.Input != 0 {
+			// Muxed from a sidecar, the file is already beside the movie
+			continue
+		}
+
+		subtitle := &ExtractedSubtitle{
+			Stream:   stream.Index,
+			Codec:    stream.CodecName,
+			Language: stream.Language,
+			Forced:   stream.Disposition.Forced != 0,
+		}
+		extracted = append(extracted, subtitle)
+
+		if !TEXT_SUBTITLE_CODECS[stream.CodecName] {
+			subtitle.Error = fmt.Sprintf("%s is a bitmap subtitle and cannot be extracted as text", stream.CodecName)
+			continue
+		}
+
+		subtitle.File = subtitleSidecarName(movie, stream, taken)
+		pending = append(pending, subtitle)
+		args = append(args, "-map", "0:"+strconv.Itoa(stream.Index), "-c:s", "srt", "-f", "srt", filepath.Join(dir, "transcode-"+subtitle.File))
+	}
+
+	if len(pending) == 0 {
+		return extracted, nil
+	}
+
+	ffmpeg, ffmpegArgs := worker.command("ffmpeg", args...)
+	_, err := executor.Run(ctx, ioutil.Discard, ffmpeg, ffmpegArgs...)
+	for _, subtitle := range pending {
+		partial := filepath.Join(dir, "transcode-"+subtitle.File)
+		failure := err
+		if failure == nil {
+			failure = os.Rename(partial, filepath.Join(dir, subtitle.File))
+		}
+		if failure != nil {
+			os.Remove(partial)
+			subtitle.File, subtitle.Error = "", failure.Error()
+		}
+	}
+	return extracted, err
+}
+
+// removeExtractedSubtitles deletes the sidecars a transcode wrote, so a rerun starts from the original alone.
+func removeExtractedSubtitles(movieDir string, meta *Transcode) error {
+	for _, subtitle := range meta.ExtractedSubtitles {
+		if subtitle.File == "" {
+			continue
+		}
+		if err := os.Remove(filepath.Join(movieDir, subtitle.File)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
@@ -3,8 +3,6 @@ package main
 
 import (
 	"regexp"
-	"strconv"
-	"strings"
 )
 
 /**
@@ -37,56 +35,3 @@ func groupsFromRegex(r *regexp.Regexp, search string) (paramsMap map[string]stri
 	}
 	return
 }
-
-func FilterEnglishStreams(streams []interface{}) []string {
-	english := make([]string, 0)
-	for _, _stream := range streams {
-		stream, ok := _stream.(map[string]interface{})
-		if !ok {
-			return english
-		}
-
-		if stream["codec_type"] == "audio" || stream["codec_type"] == "subtitle" {
-			tags, ok := stream["tags"].(map[string]interface{})
-			if !ok {
-				continue
-			}
-
-			if language, ok := tags["language"]; ok && strings.ToLower(language.(string)) == "eng" {
-				english = append(english, "-map", "0:"+strconv.Itoa(int(stream["index"].(float64))))
-			} else if title, ok := tags["title"]; ok && strings.HasPrefix(strings.ToLower(title.(string)), "english") {
-				english = append(english, "-map", "0:"+strconv.Itoa(int(stream["index"].(float64))))
-			}
-		}
-	}
-
-	return english
-}
-
-func HasAttachmentStreams(streams []interface{}) bool {
-	for _, _stream := range streams {
-		stream, ok := _stream.(map[string]interface{})
-		if !ok {
-			return false
-		}
-
-		if stream["codec_type"] == "attachment" {
-			return true
-		}
-	}
-
-	return false
-}
-
-func findVideoStream(streams []interface{}) map[string]interface{} {
-	for _, stream := range streams {
-		if video, ok := stream.(map[string]interface{}); !ok {
-			return nil
-		} else if codec, ok := video["codec_type"]; !ok {
-			continue
-		} else if codec == "video" {
-			return video
-		}
-	}
-	return nil
-}
@@ -0,0 +1,223 @@
+//By TimTheSinner
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+/**
+ * Copyright (c) 2016 TimTheSinner All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+const (
+	DEFAULT_VERIFY_SAMPLES   = 3
+	DEFAULT_VERIFY_LENGTH    = 10 * time.Second
+	DEFAULT_DURATION_DRIFT   = 2 * time.Second
+	DEFAULT_VERIFY_MIN_SSIM  = 0.95
+	VERIFY_COMPARISON_FORMAT = "yuv420p"
+)
+
+var (
+	ssimSummary = regexp.MustCompile(`SSIM .*All:([0-9.]+|inf)`)
+	psnrSummary = regexp.MustCompile(`PSNR .*average:([0-9.]+|inf)`)
+)
+
+// VerifyPolicy compares an encode against its source before it is allowed to replace it.
+// Leaving both MinSSIM and MinPSNR unset checks SSIM against DEFAULT_VERIFY_MIN_SSIM.
+type VerifyPolicy struct {
+	Samples          int      `json:"samples,omitempty"`
+	SampleLength     Duration `json:"sampleLength,omitempty"`
+	MaxDurationDrift Duration `json:"maxDurationDrift,omitempty"`
+	MinSSIM          float64  `json:"minSSIM,omitempty"`
+	MinPSNR          float64  `json:"minPSNR,omitempty"`
+}
+
+func flagVerifyPolicy() *VerifyPolicy {
+	if !*verify {
+		return nil
+	}
+	return &VerifyPolicy{}
+}
+
+func (p *VerifyPolicy) applyDefaults() {
+	if p.Samples == 0 {
+		p.Samples = DEFAULT_VERIFY_SAMPLES
+	}
+	if p.SampleLength.Duration == 0 {
+		p.SampleLength.Duration = DEFAULT_VERIFY_LENGTH
+	}
+	if p.MaxDurationDrift.Duration == 0 {
+		p.MaxDurationDrift.Duration = DEFAULT_DURATION_DRIFT
+	}
+	if p.MinSSIM == 0 && p.MinPSNR == 0 {
+		p.MinSSIM = DEFAULT_VERIFY_MIN_SSIM
+	}
+}
+
+func (p *VerifyPolicy) Validate() error {
+	if p.Samples < 0 || p.SampleLength.Duration < 0 || p.MaxDurationDrift.Duration < 0 {
+		return fmt.Errorf("Verify policy values must not be negative")
+	} else if p.MinSSIM < 0 || p.MinSSIM > 1 {
+		return fmt.Errorf("Verify minSSIM must be between 0 and 1")
+	} else if p.MinPSNR < 0 {
+		return fmt.Errorf("Verify minPSNR must not be negative")
+	}
+	return nil
+}
+
+// Verification is what the gate measured, SSIM and PSNR are the worst sampled segment.
+type Verification struct {
+	VerifiedAt    time.Time `json:"verifiedAt"`
+	DurationDrift string    `json:"durationDrift"`
+	Samples       int       `json:"samples"`
+	SSIM          float64   `json:"ssim,omitempty"`
+	PSNR          float64   `json:"psnr,omitempty"`
+}
+
+// verifyTranscode refuses encodes that are truncated, dropped a selected stream or fall below the quality thresholds.
+func verifyTranscode(ctx context.Context, executor Executor, policy *VerifyPolicy, worker *Worker, original string, originalProbe *Probe, selection *StreamSelection, graph *FilterGraph, transcoded string) (*Verification, error) {
+	transcodedProbe, err := probeMovie(ctx, executor, transcoded)
+	if err != nil {
+		return nil, err
+	}
+
+	originalDuration, err := originalProbe.Duration()
+	if err != nil {
+		return nil, fmt.Errorf("Original duration: %v", err)
+	}
+
+	transcodedDuration, err := transcodedProbe.Duration()
+	if err != nil {
+		return nil, fmt.Errorf("Transcoded duration: %v", err)
+	}
+
+	drift := transcodedDuration - originalDuration
+	if drift < 0 {
+		drift = -drift
+	}
+	if drift > policy.MaxDurationDrift.Duration {
+		return nil, fmt.Errorf("Transcode is %s long but the original is %s", transcodedDuration, originalDuration)
+	}
+
+	expected := map[string]int{"video": 1, "audio": len(selection.Audio), "subtitle": len(selection.Subtitles)}
+	for codecType, count := range expected {
+		if actual := len(transcodedProbe.StreamsOfType(codecType)); actual != count {
+			return nil, fmt.Errorf("Transcode has %d %s streams, expected %d", actual, codecType, count)
+		}
+	}
+
+	transcodedStream, err := transcodedProbe.VideoStream()
+	if err != nil {
+		return nil, err
+	}
+
+	verification := &Verification{
+		DurationDrift: drift.String(),
+		SSIM:          math.Inf(1),
+		PSNR:          math.Inf(1),
+	}
+
+	for _, start := range sampleOffsets(originalDuration, policy.Samples, policy.SampleLength.Duration) {
+		ssim, psnr, err := compareSegment(ctx, executor, worker, original, transcoded, transcodedStream, graph, start, policy.SampleLength.Duration)
+		if err != nil {
+			return nil, err
+		}
+
+		verification.Samples++
+		verification.SSIM = math.Min(verification.SSIM, ssim)
+		verification.PSNR = math.Min(verification.PSNR, psnr)
+	}
+
+	// Identical frames score an infinite PSNR, which JSON cannot represent
+	if math.IsInf(verification.SSIM, 1) {
+		verification.SSIM = 1
+	}
+	if math.IsInf(verification.PSNR, 1) {
+		verification.PSNR = 0
+	}
+
+	if policy.MinSSIM > 0 && verification.SSIM < policy.MinSSIM {
+		return verification, fmt.Errorf("SSIM %.4f is below %.4f", verification.SSIM, policy.MinSSIM)
+	} else if policy.MinPSNR > 0 && verification.PSNR != 0 && verification.PSNR < policy.MinPSNR {
+		return verification, fmt.Errorf("PSNR %.2f is below %.2f", verification.PSNR, policy.MinPSNR)
+	}
+
+	verification.VerifiedAt = time.Now()
+	return verification, nil
+}
+
+// sampleOffsets spreads samples evenly through the movie, short movies are compared as a single segment.
+func sampleOffsets(duration time.Duration, samples int, length time.Duration) []time.Duration {
+	if duration <= length*time.Duration(samples) {
+		return []time.Duration{0}
+	}
+
+	offsets := make([]time.Duration, 0, samples)
+	for i := 1; i <= samples; i++ {
+		offset := duration*time.Duration(i)/time.Duration(samples+1) - length/2
+		if offset < 0 {
+			offset = 0
+		}
+		offsets = append(offsets, offset)
+	}
+	return offsets
+}
+
+// compareSegment scores a segment of the transcode against the original, put through the frame and color changes
+// of the encode's graph and scaled to the same frame size.
+func compareSegment(ctx context.Context, executor Executor, worker *Worker, original, transcoded string, transcodedStream *Stream, graph *FilterGraph, start, length time.Duration) (ssim, psnr float64, err error) {
+	seek := strconv.FormatFloat(start.Seconds(), 'f', 3, 64)
+	span := strconv.FormatFloat(length.Seconds(), 'f', 3, 64)
+
+	reference := graph.Reference().ScaleTo(transcodedStream.Width, transcodedStream.Height, "bicubic").Format(VERIFY_COMPARISON_FORMAT)
+	lavfi := fmt.Sprintf("[0:v:0]format=%[1]s,split[d1][d2];%[2]s;[ref]split[r1][r2];[d1][r1]ssim;[d2][r2]psnr",
+		VERIFY_COMPARISON_FORMAT, reference.Complex("1:v:0", "ref"))
+
+	ffmpeg, ffmpegArgs := worker.command("ffmpeg",
+		"-nostdin", "-hide_banner", "-nostats",
+		"-ss", seek, "-t", span, "-i", transcoded,
+		"-ss", seek, "-t", span, "-i", original,
+		"-lavfi", lavfi,
+		"-f", "null", "-")
+
+	stderr, err := executor.Run(ctx, ioutil.Discard, ffmpeg, ffmpegArgs...)
+	if err != nil {
+		return 0, 0, err
+	}
+	return parseQuality(stderr)
+}
+
+// parseQuality reads the summaries the ssim and psnr filters print when they are torn down.
+func parseQuality(stderr string) (ssim, psnr float64, err error) {
+	ssimMatch := ssimSummary.FindStringSubmatch(stderr)
+	psnrMatch := psnrSummary.FindStringSubmatch(stderr)
+	if ssimMatch == nil || psnrMatch == nil {
+		return 0, 0, fmt.Errorf("ffmpeg did not report SSIM and PSNR")
+	}
+
+	if ssim, err = strconv.ParseFloat(ssimMatch[1], 64); err != nil {
+		return 0, 0, err
+	}
+	if psnr, err = strconv.ParseFloat(psnrMatch[1], 64); err != nil {
+		return 0, 0, err
+	}
+	return ssim, psnr, nil
+}
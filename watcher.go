@@ -0,0 +1,213 @@
+//By TimTheSinner
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+/**
+ * Copyright (c) 2016 TimTheSinner All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// How long a directory must go without changes before it is queued, downloads write for a while
+const WATCH_QUIESCE = 20 * time.Second
+
+// RecursiveWatcher watches every directory below a library root, following directories as they
+// appear, vanish or get renamed, and reports each changed directory once it has gone quiet.
+type RecursiveWatcher struct {
+	root    string
+	watcher *fsnotify.Watcher
+	quiesce time.Duration
+
+	lock    sync.Mutex
+	dirs    map[string]bool
+	pending map[string]*time.Timer
+}
+
+func NewRecursiveWatcher(root string) (*RecursiveWatcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	w := &RecursiveWatcher{
+		root:    filepath.Clean(root),
+		watcher: watcher,
+		quiesce: WATCH_QUIESCE,
+		dirs:    make(map[string]bool),
+		pending: make(map[string]*time.Timer),
+	}
+
+	if err := w.AddTree(w.root); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// AddTree watches dir and every directory below it.
+func (w *RecursiveWatcher) AddTree(dir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			// Removed while we were walking, the remove event cleans up after it
+			return nil
+		} else if err != nil {
+			return err
+		} else if !info.IsDir() {
+			return nil
+		} else if path != w.root && strings.HasPrefix(info.Name(), ".") {
+			return filepath.SkipDir
+		}
+
+		w.lock.Lock()
+		defer w.lock.Unlock()
+
+		if w.dirs[path] {
+			return nil
+		}
+		if err := w.watcher.Add(path); err != nil {
+			return watchLimitError(err, len(w.dirs))
+		}
+		w.dirs[path] = true
+		return nil
+	})
+}
+
+// removeTree forgets dir and everything below it, the kernel has usually dropped the watches already.
+func (w *RecursiveWatcher) removeTree(dir string) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	prefix := dir + string(filepath.Separator)
+	for path := range w.dirs {
+		if path == dir || strings.HasPrefix(path, prefix) {
+			w.watcher.Remove(path)
+			delete(w.dirs, path)
+		}
+	}
+}
+
+func (w *RecursiveWatcher) watching(dir string) bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.dirs[dir]
+}
+
+// Watched is the number of directories currently registered.
+func (w *RecursiveWatcher) Watched() int {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return len(w.dirs)
+}
+
+// changed reports dir after it has been quiet for the quiesce period, restarting the wait on every change.
+func (w *RecursiveWatcher) changed(dir string, report func(dir string)) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if timer, ok := w.pending[dir]; ok {
+		timer.Reset(w.quiesce)
+		return
+	}
+
+	w.pending[dir] = time.AfterFunc(w.quiesce, func() {
+		w.lock.Lock()
+		delete(w.pending, dir)
+		w.lock.Unlock()
+
+		report(dir)
+	})
+}
+
+// ignored skips the files this program writes itself.
+func ignored(name string) bool {
+	base := filepath.Base(name)
+	return base == "transcoding.lck" || strings.HasPrefix(base, "transcode-") || strings.HasPrefix(base, ".")
+}
+
+// Run reports directories that changed until the watcher is closed.
+func (w *RecursiveWatcher) Run(report func(dir string)) {
+	for {
+		select {
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			w.handle(event, report)
+
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			fmt.Println("Encountered error watching", w.root, err)
+		}
+	}
+}
+
+func (w *RecursiveWatcher) handle(event fsnotify.Event, report func(dir string)) {
+	name := filepath.Clean(event.Name)
+	if ignored(name) {
+		return
+	}
+
+	if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+		// A renamed directory shows up again as a create under its new name
+		if w.watching(name) {
+			w.removeTree(name)
+		}
+		return
+	}
+
+	info, err := os.Stat(name)
+	if err != nil {
+		return
+	}
+
+	dir := filepath.Dir(name)
+	if info.IsDir() {
+		if event.Op&fsnotify.Create != 0 {
+			if err := w.AddTree(name); err != nil {
+				fmt.Println("Could not watch", name, err)
+			}
+		}
+		dir = name
+	}
+
+	// Files directly in the library root are not part of any movie
+	if dir == w.root {
+		return
+	}
+
+	fmt.Println("File watcher updated", name, event.Op)
+	w.changed(dir, report)
+}
+
+func (w *RecursiveWatcher) Close() error {
+	w.lock.Lock()
+	for dir, timer := range w.pending {
+		timer.Stop()
+		delete(w.pending, dir)
+	}
+	w.lock.Unlock()
+
+	return w.watcher.Close()
+}
@@ -0,0 +1,43 @@
+// +build linux
+
+//By TimTheSinner
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"syscall"
+)
+
+/**
+ * Copyright (c) 2016 TimTheSinner All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+const INOTIFY_WATCH_LIMIT = "/proc/sys/fs/inotify/max_user_watches"
+
+// watchLimitError explains inotify running out of watches, which the kernel only reports as ENOSPC.
+func watchLimitError(err error, watched int) error {
+	if !errors.Is(err, syscall.ENOSPC) {
+		return err
+	}
+
+	limit := "the limit"
+	if raw, readErr := ioutil.ReadFile(INOTIFY_WATCH_LIMIT); readErr == nil {
+		limit = strings.TrimSpace(string(raw))
+	}
+	return fmt.Errorf("Ran out of inotify watches after watching %d directories (fs.inotify.max_user_watches is %s), raise it with: sysctl fs.inotify.max_user_watches=524288", watched, limit)
+}
@@ -0,0 +1,56 @@
+//By TimTheSinner
+package main
+
+import (
+	"fmt"
+)
+
+/**
+ * Copyright (c) 2016 TimTheSinner All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Worker is a single transcode slot, Threads and CPUs bound the resources its ffmpeg may use.
+type Worker struct {
+	ID      int    `json:"-"`
+	Threads int    `json:"threads,omitempty"`
+	CPUs    string `json:"cpus,omitempty"`
+}
+
+func (w *Worker) String() string {
+	return fmt.Sprintf("worker-%d", w.ID)
+}
+
+func (w *Worker) Validate() error {
+	if w.Threads < 0 {
+		return fmt.Errorf("%s has a negative thread count", w)
+	}
+	return validateAffinity(w.CPUs)
+}
+
+// command wraps a command so it is pinned to the worker's CPUs.
+func (w *Worker) command(command string, args ...string) (string, []string) {
+	if w == nil || w.CPUs == "" {
+		return command, args
+	}
+	return affinityCommand(w.CPUs, command, args)
+}
+
+func flagWorkers() []*Worker {
+	workers := make([]*Worker, 0, *workerCount)
+	for i := 0; i < *workerCount; i++ {
+		workers = append(workers, &Worker{Threads: *threads})
+	}
+	return workers
+}